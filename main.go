@@ -15,17 +15,22 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/GoogleCloudPlatform/k8s-node-termination-handler/termination"
+	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -37,14 +42,47 @@ import (
 const eventSource = "NodeTerminationHandler"
 
 var (
-	inClusterVar        = flag.Bool("in-cluster", true, "Set to false if run outside of a k8s cluster.")
-	regularVMTimeoutVar = flag.Duration("regular-vm-timeout", time.Hour, "Termination timeout for regular VMs. Defaults to an hour which is the timeout duration of GPU VMs.")
-	excludePodsVar      = flag.String("exclude-pods", "", "List of pods to exclude from graceful eviction. Expected format is comma separated 'podName:podNamespace'.")
-	kubeconfig          *string
+	inClusterVar                    = flag.Bool("in-cluster", true, "Set to false if run outside of a k8s cluster.")
+	regularVMTimeoutVar             = flag.Duration("regular-vm-timeout", time.Hour, "Termination timeout for regular VMs. Defaults to an hour which is the timeout duration of GPU VMs.")
+	scheduledTerminationLeadTimeVar = flag.Duration("scheduled-termination-lead-time", 10*time.Minute, "Time ahead of the scheduled termination of GCE VMs created with a max run duration or termination time at which pods start being evicted.")
+	excludePodsVar                  = flag.String("exclude-pods", "", "List of pods to exclude from graceful eviction. Expected format is comma separated 'podName:podNamespace'.")
+	excludeNamespacesVar            = flag.String("exclude-namespaces", "", "Comma separated list of namespaces whose pods are excluded from graceful eviction. Glob patterns such as 'monitoring-*' are supported.")
+	excludePodSelectorVar           = flag.String("exclude-pod-selector", "", "Label selector of pods to exclude from graceful eviction, e.g. 'app=fluentbit'.")
+	excludeAnnotationVar            = flag.String("exclude-annotation", "node-termination-handler/exclude", "Pods on which this annotation is set to 'true' are excluded from graceful eviction. Set to an empty string to disable.")
+	kubeconfig                      *string
 	// TODO: Update this to use NoExecute taints once that graduates out of alpha.
-	taintVar                = flag.String("taint", "", "Taint to place on the node while handling terminations. Example: cloud.google.com/impending-node-termination::NoSchedule")
-	annotationVar           = flag.String("annotation", "", "Annotation to set on Node objects while handling terminations")
-	systemPodGracePeriodVar = flag.Duration("system-pod-grace-period", 30*time.Second, "Time required for system pods to exit gracefully.")
+	taintVar                    = flag.String("taint", "", "Taint to place on the node while handling terminations. Example: cloud.google.com/impending-node-termination::NoSchedule")
+	annotationVar               = flag.String("annotation", "", "Annotation to set on Node objects while handling terminations")
+	liveMigrationAnnotationVar  = flag.String("live-migration-annotation", "cloud.google.com/live-migration-in-progress", "Annotation to set on Node objects while the underlying VM is being live migrated. Set to an empty string to disable.")
+	liveMigrationHookVar        = flag.String("live-migration-hook", "", "Optional command to run with argument 'start' when a live migration is announced and 'end' once it completed, e.g. to pause latency sensitive pods.")
+	liveMigrationHookTimeoutVar = flag.Duration("live-migration-hook-timeout", 30*time.Second, "Time after which the live migration hook is killed.")
+	advanceNoticeTaintVar       = flag.String("advance-notice-taint", "", "Taint to place on the node once maintenance is announced ahead of time, e.g. 'cloud.google.com/upcoming-maintenance::PreferNoSchedule'. No taint is placed if empty.")
+	systemPodGracePeriodVar     = flag.Duration("system-pod-grace-period", 30*time.Second, "Time required for system pods to exit gracefully.")
+	pdbForceDeleteThresholdVar  = flag.Duration("pdb-force-delete-threshold", time.Minute, "Pods whose eviction is still refused by a PodDisruptionBudget are deleted once less than this much time is left before the termination.")
+	maxConcurrentEvictionsVar   = flag.Int("max-concurrent-evictions", 10, "Maximum number of pods evicted at the same time.")
+	evictionQPSVar              = flag.Float64("eviction-qps", 20, "Maximum number of eviction requests sent to the API server per second.")
+	priorityTiersFileVar        = flag.String("shutdown-grace-period-by-pod-priority-file", "", "YAML or JSON file listing pod priority tiers in the same format as the kubelet shutdownGracePeriodByPodPriority setting, e.g. '[{priority: 0, shutdownGracePeriodSeconds: 60}, {priority: 2000000000, shutdownGracePeriodSeconds: 30}]'. Tiers are evicted lowest priority first. Overrides --system-pod-grace-period.")
+	evictionPhasesFileVar       = flag.String("eviction-phases-file", "", "YAML or JSON file listing the phases pods are evicted in, in order. Each phase selects pods by 'namespaces' and/or label 'selector' and has a 'gracePeriodStrategy' of either 'Fixed', using 'gracePeriodSeconds', or 'Remaining'. Exactly one phase must not select any pods and collects all other pods. Overrides --system-pod-grace-period.")
+	evictDaemonSetPodsVar       = flag.Bool("evict-daemonset-pods", false, "Set to true to evict DaemonSet pods in the last eviction phase. They are left running otherwise.")
+	justInTimeEvictionVar       = flag.Bool("just-in-time-eviction", false, "Set to true to keep pods running until only their shutdown budget is left before the end of their eviction phase. The budget is read from the 'node-termination-handler/shutdown-budget-seconds' annotation and defaults to the pod's terminationGracePeriodSeconds.")
+	forceDeleteLeadTimeVar      = flag.Duration("force-delete-lead-time", 0, "Time before the eviction deadline at which evicted pods that still exist are deleted with a grace period of 0. Pods outliving their eviction are left alone if 0.")
+	stripFinalizersVar          = flag.String("strip-finalizers", "", "Comma separated list of glob patterns of finalizers to remove from pods deleted with a grace period of 0, e.g. 'example.com/*'. Requires --force-delete-lead-time.")
+	reportNamespaceVar          = flag.String("report-namespace", os.Getenv("POD_NAMESPACE"), "Namespace of the ConfigMap 'node-termination-report-<node>' in which the last drain reports of the node are persisted. Reports are only logged and summarized in an event if empty. Defaults to the POD_NAMESPACE environment variable.")
+	justInTimeSafetyMarginVar   = flag.Duration("just-in-time-safety-margin", 30*time.Second, "Time by which just-in-time evictions are expected to complete ahead of the end of their eviction phase.")
+	providerVar                 = flag.String("provider", "gce", "Comma separated list of termination sources to watch. Supported sources are 'gce', 'aws', 'azure', 'http' and 'annotation'. Pending terminations reported by any of them are handled.")
+	awsMetadataEndpointVar      = flag.String("aws-metadata-endpoint", "http://169.254.169.254", "Address of the EC2 instance metadata service.")
+	awsDrainOnRebalanceVar      = flag.Bool("aws-drain-on-rebalance", false, "Set to true to handle EC2 rebalance recommendations as impending terminations.")
+	awsEventLeadTimeVar         = flag.Duration("aws-scheduled-event-lead-time", 10*time.Minute, "Time ahead of the start of EC2 scheduled events at which pods start being evicted. Events starting later are reported as upcoming maintenance.")
+	azureMetadataEndpointVar    = flag.String("azure-metadata-endpoint", "http://169.254.169.254", "Address of the Azure instance metadata service.")
+	nodeNameVar                 = flag.String("node-name", os.Getenv("NODE_NAME"), "Name of the node the handler runs on. Required by sources that cannot discover it from cloud metadata. Defaults to the NODE_NAME environment variable.")
+	httpTriggerAddressVar       = flag.String("http-trigger-address", ":8080", "Address on which the http trigger accepts termination requests.")
+	httpTriggerTokenFileVar     = flag.String("http-trigger-token-file", "", "File containing the bearer token expected by the http trigger. Requires --http-trigger-tls-cert-file.")
+	httpTriggerCertFileVar      = flag.String("http-trigger-tls-cert-file", "", "TLS certificate served by the http trigger.")
+	httpTriggerKeyFileVar       = flag.String("http-trigger-tls-key-file", "", "TLS private key of the http trigger certificate.")
+	httpTriggerClientCAVar      = flag.String("http-trigger-client-ca-file", "", "CA bundle used to verify client certificates presented to the http trigger.")
+	drainAnnotationVar          = flag.String("drain-annotation", "node-termination-handler/drain-by", "Node annotation watched by the annotation source. Its value is the RFC3339 time by which the node must be drained.")
+	shadowVar                   = flag.Bool("shadow", false, "Set to true to handle real terminations without tainting or annotating nodes, evicting pods, running hooks, acknowledging terminations, sending slack notifications or rebooting. The taint, eviction plan and reboot decision are logged, recorded in events and published as drain reports instead.")
+	stateFileVar                = flag.String("state-file", "", "File in which the time pending terminations were first observed is persisted, such that termination deadlines survive restarts of the handler. Observations are only kept in memory if empty.")
 )
 
 func main() {
@@ -54,14 +92,32 @@ func main() {
 		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
 	flag.Parse()
-	client, err := getKubeClient()
+	config, err := getKubeConfig()
 	if err != nil {
 		glog.Fatalf("Failed to get kubernetes API Server Client. Error: %v", err)
 	}
-	excludePods, err := processExcludePods()
+	// creates the clientset
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		glog.Fatalf("Failed to get kubernetes API Server Client. Error: %v", err)
+	}
+	executor, err := termination.NewPodExecutor(config)
+	if err != nil {
+		glog.Fatalf("Failed to create pod executor. Error: %v", err)
+	}
+	exclusions, err := processExclusions()
 	if err != nil {
 		glog.Fatal(err)
 	}
+	if *maxConcurrentEvictionsVar <= 0 {
+		glog.Fatalf("--max-concurrent-evictions must be positive")
+	}
+	if *evictionQPSVar <= 0 {
+		glog.Fatalf("--eviction-qps must be positive")
+	}
+	if *justInTimeSafetyMarginVar < 0 {
+		glog.Fatalf("--just-in-time-safety-margin must not be negative")
+	}
 	if *taintVar == "" && *annotationVar == "" {
 		glog.Fatalf("Must specify one of taint or annotation")
 	}
@@ -69,19 +125,91 @@ func main() {
 	if err != nil {
 		glog.Fatal(err)
 	}
-	glog.Infof("Excluding pods %v", excludePods)
+	advanceNoticeTaint, err := parseTaint("--advance-notice-taint", *advanceNoticeTaintVar)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	priorityTiers, err := processPriorityTiers()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	evictionPhases, err := processEvictionPhases()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	finalizerAllowlist := splitList(*stripFinalizersVar)
+	if err := termination.ValidateFinalizerAllowlist(finalizerAllowlist); err != nil {
+		glog.Fatal(err)
+	}
+	if *forceDeleteLeadTimeVar < 0 {
+		glog.Fatalf("--force-delete-lead-time must not be negative")
+	}
+	if *awsEventLeadTimeVar < 0 {
+		glog.Fatalf("--aws-scheduled-event-lead-time must not be negative")
+	}
+	glog.Infof("Excluding %v", exclusions)
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(glog.Infof)
 	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: client.CoreV1().Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventSource})
-	gceTerminationSource, err := termination.NewGCETerminationSource(*regularVMTimeoutVar)
+	providers := strings.Split(*providerVar, ",")
+	var metadataClient termination.MetadataClient
+	for _, provider := range providers {
+		if provider == "gce" {
+			metadataClient = termination.NewGCEMetadataClient()
+		}
+	}
+	observations, err := termination.NewObservationStore(*stateFileVar)
+	if err != nil {
+		glog.Fatalf("Failed to load termination observations from %q: %v", *stateFileVar, err)
+	}
+	terminationSource, err := getTerminationSources(providers, metadataClient, observations, client)
 	if err != nil {
 		glog.Fatal(err)
 	}
-	nodeName := gceTerminationSource.GetState().NodeName
-	taintHandler := termination.NewNodeTaintHandler(taint, *annotationVar, nodeName, client, recorder)
-	evictionHandler := termination.NewPodEvictionHandler(nodeName, client, recorder, *systemPodGracePeriodVar)
-	terminationHandler := termination.NewNodeTerminationHandler(gceTerminationSource, taintHandler, evictionHandler, excludePods)
+	nodeName := terminationSource.GetState().NodeName
+	newTaintHandler := termination.NewNodeTaintHandler
+	newEvictionHandler := termination.NewPodEvictionHandler
+	rebooter := termination.NewNodeRebooter()
+	if *shadowVar {
+		glog.Infof("Running in shadow mode. Nodes and pods are left untouched")
+		newTaintHandler = termination.NewShadowNodeTaintHandler
+		newEvictionHandler = termination.NewShadowPodEvictionHandler
+		rebooter = termination.NewShadowNodeRebooter(nodeName, recorder)
+		terminationSource = termination.NewShadowTerminationSource(terminationSource)
+	}
+	taintHandler := newTaintHandler(taint, advanceNoticeTaint, *annotationVar, *liveMigrationAnnotationVar, nodeName, client, recorder)
+	evictionHandler, err := newEvictionHandler(nodeName, client, recorder, termination.PodEvictionOptions{
+		PDBForceDeleteThreshold: *pdbForceDeleteThresholdVar,
+		MaxConcurrentEvictions:  *maxConcurrentEvictionsVar,
+		EvictionQPS:             float32(*evictionQPSVar),
+		PriorityTiers:           priorityTiers,
+		Phases:                  evictionPhases,
+		EvictDaemonSetPods:      *evictDaemonSetPodsVar,
+		Executor:                executor,
+		JustInTime:              *justInTimeEvictionVar,
+		SafetyMargin:            *justInTimeSafetyMarginVar,
+		ForceDeleteLeadTime:     *forceDeleteLeadTimeVar,
+		FinalizerAllowlist:      finalizerAllowlist,
+		ReportNamespace:         *reportNamespaceVar,
+	})
+	if err != nil {
+		glog.Fatalf("Failed to create pod eviction handler. Error: %v", err)
+	}
+	var liveMigrationHook termination.LiveMigrationHook
+	if *liveMigrationHookVar != "" && *shadowVar {
+		glog.Infof("Not running live migration hook %q in shadow mode", *liveMigrationHookVar)
+	} else if *liveMigrationHookVar != "" {
+		liveMigrationHook = termination.NewCommandLiveMigrationHook(*liveMigrationHookVar, *liveMigrationHookTimeoutVar)
+	}
+	var notifier termination.Notifier
+	if url := os.Getenv("SLACK_WEBHOOK_URL"); url != "" && *shadowVar {
+		// Notifications would announce terminations that are not acted upon.
+		glog.Infof("Not sending slack notifications in shadow mode")
+	} else if url != "" {
+		notifier = termination.NewSlackNotifier(url, metadataClient)
+	}
+	terminationHandler := termination.NewNodeTerminationHandler(terminationSource, taintHandler, evictionHandler, exclusions, notifier, liveMigrationHook, rebooter, nodeName, recorder)
 	err = terminationHandler.Start()
 	if err != nil {
 		glog.Fatal(err)
@@ -89,7 +217,7 @@ func main() {
 	glog.Fatalf("Unexpected execution flow")
 }
 
-func getKubeClient() (*kubernetes.Clientset, error) {
+func getKubeConfig() (*rest.Config, error) {
 	var (
 		config *rest.Config
 		err    error
@@ -107,32 +235,165 @@ func getKubeClient() (*kubernetes.Clientset, error) {
 		}
 	}
 	glog.V(10).Infof("Using kube config: %+v", config)
-	// creates the clientset
-	return kubernetes.NewForConfig(config)
+	return config, nil
+}
+
+func getTerminationSources(providers []string, metadataClient termination.MetadataClient, observations *termination.ObservationStore, client *kubernetes.Clientset) (termination.NodeTerminationSource, error) {
+	if len(providers) == 1 {
+		return getTerminationSource(providers[0], metadataClient, observations, client)
+	}
+	sources := map[string]termination.NodeTerminationSource{}
+	for _, provider := range providers {
+		if _, exists := sources[provider]; exists {
+			return nil, fmt.Errorf("Termination source %q specified more than once", provider)
+		}
+		source, err := getTerminationSource(provider, metadataClient, observations, client)
+		if err != nil {
+			return nil, err
+		}
+		sources[provider] = source
+	}
+	return termination.NewCompositeTerminationSource(sources)
 }
 
-func processExcludePods() (map[string]string, error) {
-	ret := map[string]string{}
-	for _, p := range strings.Split(*excludePodsVar, ",") {
+func getTerminationSource(provider string, metadataClient termination.MetadataClient, observations *termination.ObservationStore, client *kubernetes.Clientset) (termination.NodeTerminationSource, error) {
+	switch provider {
+	case "gce":
+		return termination.NewGCETerminationSource(metadataClient, *regularVMTimeoutVar, *scheduledTerminationLeadTimeVar, observations)
+	case "aws":
+		return termination.NewAWSTerminationSource(*awsMetadataEndpointVar, *awsDrainOnRebalanceVar, *awsEventLeadTimeVar)
+	case "azure":
+		return termination.NewAzureTerminationSource(*azureMetadataEndpointVar)
+	case "http":
+		return getHTTPTriggerSource()
+	case "annotation":
+		if *nodeNameVar == "" {
+			return nil, fmt.Errorf("Must specify --node-name to use the annotation source")
+		}
+		return termination.NewAnnotationTerminationSource(*nodeNameVar, *drainAnnotationVar, client)
+	}
+	return nil, fmt.Errorf("Invalid termination source specified in --provider flag - %q", provider)
+}
+
+func getHTTPTriggerSource() (termination.NodeTerminationSource, error) {
+	if *nodeNameVar == "" {
+		return nil, fmt.Errorf("Must specify --node-name to use the http trigger")
+	}
+	var token string
+	if *httpTriggerTokenFileVar != "" {
+		b, err := ioutil.ReadFile(*httpTriggerTokenFileVar)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	var tlsConfig *tls.Config
+	if *httpTriggerCertFileVar != "" {
+		cert, err := tls.LoadX509KeyPair(*httpTriggerCertFileVar, *httpTriggerKeyFileVar)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if *httpTriggerClientCAVar != "" {
+			b, err := ioutil.ReadFile(*httpTriggerClientCAVar)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			if !tlsConfig.ClientCAs.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("No certificates found in %q", *httpTriggerClientCAVar)
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return termination.NewHTTPTriggerSource(*nodeNameVar, *httpTriggerAddressVar, token, tlsConfig)
+}
+
+func processExclusions() (*termination.PodExclusions, error) {
+	var pods []types.NamespacedName
+	for _, p := range splitList(*excludePodsVar) {
 		parts := strings.Split(p, ":")
 		if len(parts) != 2 {
 			return nil, fmt.Errorf("Invalid value specified for --exclude-pods flag - %v", *excludePodsVar)
 		}
-		ret[parts[0]] = parts[1]
+		pods = append(pods, types.NamespacedName{Name: parts[0], Namespace: parts[1]})
+	}
+	exclusions, err := termination.NewPodExclusions(pods, splitList(*excludeNamespacesVar), *excludePodSelectorVar, *excludeAnnotationVar)
+	if err != nil {
+		return nil, err
+	}
+	// The handler must keep running while the node is drained. Its own pod is described by the downward API.
+	if name, namespace := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE"); name != "" && namespace != "" {
+		exclusions.ExcludePod(name, namespace)
+	}
+	return exclusions, nil
+}
+
+// splitList splits a comma separated flag value, ignoring empty items.
+func splitList(value string) []string {
+	var ret []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+func processPriorityTiers() ([]termination.ShutdownGracePeriodByPodPriority, error) {
+	if *priorityTiersFileVar == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(*priorityTiersFileVar)
+	if err != nil {
+		return nil, err
+	}
+	var tiers []termination.ShutdownGracePeriodByPodPriority
+	if err := yaml.Unmarshal(b, &tiers); err != nil {
+		return nil, fmt.Errorf("Invalid pod priority tiers in %q - %v", *priorityTiersFileVar, err)
+	}
+	if err := termination.ValidatePriorityTiers(tiers); err != nil {
+		return nil, fmt.Errorf("Invalid pod priority tiers in %q - %v", *priorityTiersFileVar, err)
 	}
-	return ret, nil
+	return tiers, nil
+}
+
+func processEvictionPhases() ([]termination.EvictionPhase, error) {
+	if *evictionPhasesFileVar == "" {
+		phases := termination.DefaultEvictionPhases(*systemPodGracePeriodVar)
+		return phases, termination.ValidateEvictionPhases(phases)
+	}
+	if *priorityTiersFileVar != "" {
+		return nil, fmt.Errorf("Eviction phases must not be specified when pod priority tiers are specified")
+	}
+	b, err := ioutil.ReadFile(*evictionPhasesFileVar)
+	if err != nil {
+		return nil, err
+	}
+	var phases []termination.EvictionPhase
+	if err := yaml.Unmarshal(b, &phases); err != nil {
+		return nil, fmt.Errorf("Invalid eviction phases in %q - %v", *evictionPhasesFileVar, err)
+	}
+	if err := termination.ValidateEvictionPhases(phases); err != nil {
+		return nil, fmt.Errorf("Invalid eviction phases in %q - %v", *evictionPhasesFileVar, err)
+	}
+	return phases, nil
 }
 
 func processTaint() (*v1.Taint, error) {
 	if len(*annotationVar) != 0 && len(*taintVar) != 0 {
 		return nil, fmt.Errorf("Annotation must not be specified when taints are specified")
 	}
-	if len(*taintVar) == 0 {
+	return parseTaint("--taint", *taintVar)
+}
+
+func parseTaint(flagName, value string) (*v1.Taint, error) {
+	if len(value) == 0 {
 		return nil, nil
 	}
-	parts := strings.Split(*taintVar, ":")
+	parts := strings.Split(value, ":")
 	if len(parts) != 3 {
-		return nil, fmt.Errorf("Invalid value specified for --taint flag. Expected format 'name:value:effect'. Input is %q", *taintVar)
+		return nil, fmt.Errorf("Invalid value specified for %s flag. Expected format 'name:value:effect'. Input is %q", flagName, value)
 	}
 	return &v1.Taint{
 		Key:    parts[0],
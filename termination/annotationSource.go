@@ -0,0 +1,124 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	client "k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+type annotationTerminationSource struct {
+	sync.RWMutex
+	client        corev1.CoreV1Interface
+	annotation    string
+	state         NodeTerminationState
+	updateChannel chan NodeTerminationState
+}
+
+// NewAnnotationTerminationSource returns a termination source that lets operators drain `node` by setting `annotation`
+// on its Node object to the RFC3339 time by which the node must be drained. Removing the annotation cancels the drain.
+func NewAnnotationTerminationSource(node, annotation string, client *client.Clientset) (NodeTerminationSource, error) {
+	ret := &annotationTerminationSource{
+		client:        client.CoreV1(),
+		annotation:    annotation,
+		state:         NodeTerminationState{NodeName: node},
+		updateChannel: make(chan NodeTerminationState),
+	}
+	// Check if a drain is already requested. This can happen if the termination watcher restarts.
+	nodeObj, err := ret.client.Nodes().Get(node, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	ret.handleNode(nodeObj)
+	return ret, nil
+}
+
+// handleNode updates the stored state based on the annotations of `node`. It returns true if the state changed.
+func (a *annotationTerminationSource) handleNode(node *v1.Node) bool {
+	state := NodeTerminationState{NodeName: a.state.NodeName}
+	if value, exists := node.Annotations[a.annotation]; exists {
+		deadline, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			glog.Errorf("Ignoring invalid value %q of annotation %q on node %q - %v", value, a.annotation, node.Name, err)
+		} else {
+			state.PendingTermination = true
+			state.TerminationTime = deadline
+		}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if reflect.DeepEqual(state, a.state) {
+		return false
+	}
+	glog.Infof("Annotation %q on node %q changed. Pending termination: %v", a.annotation, node.Name, state.PendingTermination)
+	a.state = state
+	return true
+}
+
+func (a *annotationTerminationSource) watchNode() {
+	// Catch up with changes made while no watch was active.
+	node, err := a.client.Nodes().Get(a.state.NodeName, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("Failed to get node %q - %v", a.state.NodeName, err)
+		return
+	}
+	if a.handleNode(node) {
+		a.updateChannel <- a.GetState()
+	}
+	w, err := a.client.Nodes().Watch(metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", a.state.NodeName).String(),
+		ResourceVersion: node.ResourceVersion,
+	})
+	if err != nil {
+		glog.Errorf("Failed to watch node %q - %v", a.state.NodeName, err)
+		return
+	}
+	defer w.Stop()
+	for event := range w.ResultChan() {
+		if event.Type != watch.Added && event.Type != watch.Modified {
+			continue
+		}
+		node, ok := event.Object.(*v1.Node)
+		if !ok || node.Name != a.state.NodeName {
+			continue
+		}
+		if a.handleNode(node) {
+			a.updateChannel <- a.GetState()
+		}
+	}
+}
+
+func (a *annotationTerminationSource) WatchState() <-chan NodeTerminationState {
+	go wait.Forever(a.watchNode, time.Second)
+	return a.updateChannel
+}
+
+func (a *annotationTerminationSource) GetState() NodeTerminationState {
+	a.RLock()
+	defer a.RUnlock()
+	return a.state
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const drainAnnotation = "node-termination-handler/drain-by"
+
+func TestAnnotationTerminationSource(t *testing.T) {
+	source := &annotationTerminationSource{
+		annotation:    drainAnnotation,
+		state:         NodeTerminationState{NodeName: "localhost"},
+		updateChannel: make(chan NodeTerminationState),
+	}
+	deadline := time.Date(2018, time.June, 1, 10, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		desc            string
+		annotations     map[string]string
+		expectedChange  bool
+		expectedPending bool
+	}{
+		{
+			desc:        "no annotation",
+			annotations: map[string]string{},
+		},
+		{
+			desc:            "drain requested",
+			annotations:     map[string]string{drainAnnotation: deadline.Format(time.RFC3339)},
+			expectedChange:  true,
+			expectedPending: true,
+		},
+		{
+			desc:            "unrelated update",
+			annotations:     map[string]string{drainAnnotation: deadline.Format(time.RFC3339), "foo": "bar"},
+			expectedPending: true,
+		},
+		{
+			desc:           "invalid deadline",
+			annotations:    map[string]string{drainAnnotation: "tomorrow"},
+			expectedChange: true,
+		},
+		{
+			desc:            "drain requested again",
+			annotations:     map[string]string{drainAnnotation: deadline.Format(time.RFC3339)},
+			expectedChange:  true,
+			expectedPending: true,
+		},
+		{
+			desc:           "annotation removed",
+			annotations:    map[string]string{},
+			expectedChange: true,
+		},
+	} {
+		node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "localhost", Annotations: test.annotations}}
+		if changed := source.handleNode(node); changed != test.expectedChange {
+			t.Errorf("%s: expected change %v, got %v", test.desc, test.expectedChange, changed)
+		}
+		state := source.GetState()
+		if state.PendingTermination != test.expectedPending {
+			t.Errorf("%s: expected pending termination %v, got %+v", test.desc, test.expectedPending, state)
+		}
+		if state.PendingTermination && !state.TerminationTime.Equal(deadline) {
+			t.Errorf("%s: expected termination at %v, got %v", test.desc, deadline, state.TerminationTime)
+		}
+	}
+}
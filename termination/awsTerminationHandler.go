@@ -0,0 +1,312 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	awsTokenPath              = "/latest/api/token"
+	awsTokenTTLHeader         = "X-aws-ec2-metadata-token-ttl-seconds"
+	awsTokenHeader            = "X-aws-ec2-metadata-token"
+	awsTokenTTL               = 6 * time.Hour
+	awsLocalHostnamePath      = "/latest/meta-data/local-hostname"
+	awsSpotInstanceActionPath = "/latest/meta-data/spot/instance-action"
+	awsRebalancePath          = "/latest/meta-data/events/recommendations/rebalance"
+	awsScheduledEventsPath    = "/latest/meta-data/events/maintenance/scheduled"
+	awsScheduledEventLayout   = "2 Jan 2006 15:04:05 GMT"
+	awsScheduledEventActive   = "active"
+	awsSpotActionTerminate    = "terminate"
+	awsPollInterval           = 5 * time.Second
+	// Spot instances are interrupted two minutes after a notice is published.
+	// Rebalance recommendations carry no deadline, so the same window is assumed when draining on them.
+	awsRebalanceTerminationDuration = 2 * time.Minute
+)
+
+// awsSpotInstanceAction is the document served at `spot/instance-action`.
+type awsSpotInstanceAction struct {
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"`
+}
+
+// awsRebalanceRecommendation is the document served at `events/recommendations/rebalance`.
+type awsRebalanceRecommendation struct {
+	NoticeTime time.Time `json:"noticeTime"`
+}
+
+// awsScheduledEventReboots lists the codes of the scheduled events that take the instance down, and whether it is
+// rebooted rather than stopped or retired. Other events, such as `system-maintenance`, do not disrupt the instance.
+var awsScheduledEventReboots = map[string]bool{
+	"instance-reboot":     true,
+	"system-reboot":       true,
+	"instance-stop":       false,
+	"instance-retirement": false,
+}
+
+// awsScheduledEvent is a single entry of the list served at `events/maintenance/scheduled`.
+type awsScheduledEvent struct {
+	Code      string `json:"Code"`
+	EventID   string `json:"EventId"`
+	NotBefore string `json:"NotBefore"`
+	NotAfter  string `json:"NotAfter"`
+	State     string `json:"State"`
+}
+
+// awsMetadataClient is a minimal IMDSv2 client.
+type awsMetadataClient struct {
+	sync.Mutex
+	endpoint    string
+	client      *http.Client
+	token       string
+	tokenExpiry time.Time
+}
+
+func (c *awsMetadataClient) getToken() (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	// Refresh the session token a minute ahead of its expiry.
+	if c.token != "" && time.Now().Before(c.tokenExpiry.Add(-time.Minute)) {
+		return c.token, nil
+	}
+	req, err := http.NewRequest("PUT", c.endpoint+awsTokenPath, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(awsTokenTTLHeader, strconv.Itoa(int(awsTokenTTL.Seconds())))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status code %d trying to fetch an IMDSv2 token", resp.StatusCode)
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	c.token = string(token)
+	c.tokenExpiry = time.Now().Add(awsTokenTTL)
+	return c.token, nil
+}
+
+// get returns the value stored at `path`. `found` is false if the metadata server does not define `path`.
+func (c *awsMetadataClient) get(path string) (value string, found bool, err error) {
+	token, err := c.getToken()
+	if err != nil {
+		return "", false, err
+	}
+	req, err := http.NewRequest("GET", c.endpoint+path, nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set(awsTokenHeader, token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", false, nil
+	case http.StatusUnauthorized:
+		// The token got invalidated. Fetch a new one on the next attempt.
+		c.Lock()
+		c.token = ""
+		c.Unlock()
+		return "", false, fmt.Errorf("IMDSv2 token rejected trying to fetch %s", path)
+	default:
+		return "", false, fmt.Errorf("status code %d trying to fetch %s", resp.StatusCode, path)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, err
+	}
+	return string(body), true, nil
+}
+
+// getJSON decodes the document stored at `path` into `v`.
+func (c *awsMetadataClient) getJSON(path string, v interface{}) (bool, error) {
+	value, found, err := c.get(path)
+	if err != nil || !found {
+		return false, err
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return false, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return true, nil
+}
+
+type awsTerminationSource struct {
+	sync.RWMutex
+	client           *awsMetadataClient
+	state            NodeTerminationState
+	updateChannel    chan NodeTerminationState
+	drainOnRebalance bool
+	// scheduledEventLeadTime is the time ahead of active scheduled events at which they are reported as pending terminations.
+	scheduledEventLeadTime time.Duration
+}
+
+// NewAWSTerminationSource returns a termination source that polls the EC2 instance metadata service at `endpoint` using IMDSv2.
+// Spot interruptions are reported as pending terminations. Active scheduled maintenance events are reported as upcoming
+// maintenance, and as pending terminations once they are due within `scheduledEventLeadTime`.
+// Rebalance recommendations are reported as pending terminations only if `drainOnRebalance` is true.
+func NewAWSTerminationSource(endpoint string, drainOnRebalance bool, scheduledEventLeadTime time.Duration) (NodeTerminationSource, error) {
+	ret := &awsTerminationSource{
+		client: &awsMetadataClient{
+			endpoint: strings.TrimSuffix(endpoint, "/"),
+			client:   &http.Client{Timeout: 5 * time.Second},
+		},
+		updateChannel:          make(chan NodeTerminationState),
+		drainOnRebalance:       drainOnRebalance,
+		scheduledEventLeadTime: scheduledEventLeadTime,
+	}
+	nodeName, found, err := ret.client.get(awsLocalHostnamePath)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("instance metadata does not define %s", awsLocalHostnamePath)
+	}
+	ret.state.NodeName = nodeName
+	// Check if a termination is already pending. This can happen if the termination watcher restarts.
+	if _, err := ret.refresh(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// refresh polls the metadata server and updates the stored state. It returns true if the state changed.
+func (a *awsTerminationSource) refresh() (bool, error) {
+	state := NodeTerminationState{NodeName: a.state.NodeName}
+	var spotAction awsSpotInstanceAction
+	found, err := a.client.getJSON(awsSpotInstanceActionPath, &spotAction)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		glog.V(4).Infof("Spot instance action %q scheduled at %v", spotAction.Action, spotAction.Time)
+		// Spot instances are reclaimed by EC2. There is no point in restarting them.
+		setEarliestTermination(&state, spotAction.Time, false)
+		// Stopped and hibernated spot instances are started again once capacity is available.
+		state.WillBeStopped = spotAction.Action != awsSpotActionTerminate
+	}
+	if a.drainOnRebalance {
+		var rebalance awsRebalanceRecommendation
+		found, err := a.client.getJSON(awsRebalancePath, &rebalance)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			glog.V(4).Infof("Rebalance recommendation issued at %v", rebalance.NoticeTime)
+			setEarliestTermination(&state, rebalance.NoticeTime.Add(awsRebalanceTerminationDuration), false)
+		}
+	}
+	var events []awsScheduledEvent
+	if _, err := a.client.getJSON(awsScheduledEventsPath, &events); err != nil {
+		return false, err
+	}
+	for _, event := range events {
+		if event.State != awsScheduledEventActive {
+			continue
+		}
+		notBefore, err := time.Parse(awsScheduledEventLayout, event.NotBefore)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse start time of scheduled event %q: %v", event.EventID, err)
+		}
+		reboot, disruptive := awsScheduledEventReboots[event.Code]
+		if !disruptive {
+			glog.V(4).Infof("Ignoring scheduled event %q of type %q not before %v", event.EventID, event.Code, notBefore)
+			continue
+		}
+		if time.Until(notBefore) > a.scheduledEventLeadTime {
+			window := MaintenanceWindow{
+				Start: notBefore,
+				// Reboots can be completed ahead of the maintenance window by rebooting the instance.
+				CanReschedule: reboot,
+			}
+			if event.NotAfter != "" {
+				if window.End, err = time.Parse(awsScheduledEventLayout, event.NotAfter); err != nil {
+					return false, fmt.Errorf("failed to parse end time of scheduled event %q: %v", event.EventID, err)
+				}
+			}
+			glog.V(4).Infof("Upcoming scheduled event %q of type %q not before %v", event.EventID, event.Code, notBefore)
+			setEarliestMaintenance(&state, window)
+			continue
+		}
+		glog.V(4).Infof("Scheduled event %q of type %q not before %v", event.EventID, event.Code, notBefore)
+		setEarliestTermination(&state, notBefore, reboot)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if reflect.DeepEqual(state, a.state) {
+		return false, nil
+	}
+	a.state = state
+	return true, nil
+}
+
+// setEarliestTermination records a termination at `terminationTime` unless an earlier one is already recorded.
+func setEarliestTermination(state *NodeTerminationState, terminationTime time.Time, needsReboot bool) {
+	if state.PendingTermination && !terminationTime.Before(state.TerminationTime) {
+		return
+	}
+	state.PendingTermination = true
+	state.TerminationTime = terminationTime
+	state.NeedsReboot = needsReboot
+}
+
+// setEarliestMaintenance records maintenance announced for `window` unless earlier maintenance is already recorded.
+func setEarliestMaintenance(state *NodeTerminationState, window MaintenanceWindow) {
+	if state.UpcomingMaintenance != nil && !window.Start.Before(state.UpcomingMaintenance.Start) {
+		return
+	}
+	state.UpcomingMaintenance = &window
+}
+
+func (a *awsTerminationSource) WatchState() <-chan NodeTerminationState {
+	go wait.Forever(func() {
+		changed, err := a.refresh()
+		if err != nil {
+			glog.Errorf("Failed to get instance metadata for node %q - %v", a.state.NodeName, err)
+			return
+		}
+		if changed {
+			a.updateChannel <- a.GetState()
+		}
+	}, awsPollInterval)
+	return a.updateChannel
+}
+
+func (a *awsTerminationSource) GetState() NodeTerminationState {
+	a.RLock()
+	defer a.RUnlock()
+	return a.state
+}
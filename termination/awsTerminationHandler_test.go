@@ -0,0 +1,198 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeAWSToken = "fake-token"
+
+// fakeIMDS is a local stand-in for the EC2 instance metadata service.
+type fakeIMDS struct {
+	sync.Mutex
+	values map[string]string
+}
+
+func (f *fakeIMDS) set(path, value string) {
+	f.Lock()
+	defer f.Unlock()
+	f.values[path] = value
+}
+
+func (f *fakeIMDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == awsTokenPath {
+		if r.Method != "PUT" || r.Header.Get(awsTokenTTLHeader) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(fakeAWSToken))
+		return
+	}
+	if r.Header.Get(awsTokenHeader) != fakeAWSToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	value, exists := f.values[r.URL.Path]
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(value))
+}
+
+func TestAWSTerminationSource(t *testing.T) {
+	imds := &fakeIMDS{values: map[string]string{
+		awsLocalHostnamePath: "ip-10-0-0-1.ec2.internal",
+	}}
+	server := httptest.NewServer(imds)
+	defer server.Close()
+
+	source, err := NewAWSTerminationSource(server.URL, true, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	awsSource := source.(*awsTerminationSource)
+	if state := source.GetState(); state.NodeName != "ip-10-0-0-1.ec2.internal" || state.PendingTermination {
+		t.Fatalf("unexpected initial state: %+v", state)
+	}
+
+	for _, test := range []struct {
+		desc                string
+		path, value         string
+		expectedTermination time.Time
+		expectedReboot      bool
+	}{
+		{
+			desc:                "scheduled instance reboot",
+			path:                awsScheduledEventsPath,
+			value:               `[{"Code": "instance-reboot", "EventId": "instance-event-1", "NotBefore": "21 Jan 2019 09:00:43 GMT", "State": "active"}]`,
+			expectedTermination: time.Date(2019, time.January, 21, 9, 0, 43, 0, time.UTC),
+			expectedReboot:      true,
+		},
+		{
+			desc:                "earlier rebalance recommendation",
+			path:                awsRebalancePath,
+			value:               `{"noticeTime": "2019-01-20T08:00:00Z"}`,
+			expectedTermination: time.Date(2019, time.January, 20, 8, 2, 0, 0, time.UTC),
+		},
+		{
+			desc:                "spot interruption",
+			path:                awsSpotInstanceActionPath,
+			value:               `{"action": "terminate", "time": "2019-01-20T07:22:00Z"}`,
+			expectedTermination: time.Date(2019, time.January, 20, 7, 22, 0, 0, time.UTC),
+		},
+	} {
+		imds.set(test.path, test.value)
+		changed, err := awsSource.refresh()
+		if err != nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+		state := source.GetState()
+		if !changed || !state.PendingTermination {
+			t.Fatalf("%s: expected a pending termination, got %+v", test.desc, state)
+		}
+		if !state.TerminationTime.Equal(test.expectedTermination) {
+			t.Errorf("%s: expected termination at %v, got %v", test.desc, test.expectedTermination, state.TerminationTime)
+		}
+		if state.NeedsReboot != test.expectedReboot {
+			t.Errorf("%s: expected NeedsReboot %v, got %v", test.desc, test.expectedReboot, state.NeedsReboot)
+		}
+	}
+
+	// Canceled events and expired notices clear the pending termination.
+	imds.Lock()
+	delete(imds.values, awsSpotInstanceActionPath)
+	delete(imds.values, awsRebalancePath)
+	imds.values[awsScheduledEventsPath] = `[{"Code": "instance-reboot", "EventId": "instance-event-1", "NotBefore": "21 Jan 2019 09:00:43 GMT", "State": "canceled"}]`
+	imds.Unlock()
+	if _, err := awsSource.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if state := source.GetState(); state.PendingTermination {
+		t.Fatalf("expected no pending termination, got %+v", state)
+	}
+}
+
+func TestAWSScheduledEventCodes(t *testing.T) {
+	for _, test := range []struct {
+		code                string
+		expectedTermination bool
+		expectedReboot      bool
+	}{
+		{code: "instance-reboot", expectedTermination: true, expectedReboot: true},
+		{code: "system-reboot", expectedTermination: true, expectedReboot: true},
+		{code: "instance-stop", expectedTermination: true},
+		{code: "instance-retirement", expectedTermination: true},
+		{code: "system-maintenance"},
+	} {
+		imds := &fakeIMDS{values: map[string]string{
+			awsLocalHostnamePath:   "ip-10-0-0-1.ec2.internal",
+			awsScheduledEventsPath: fmt.Sprintf(`[{"Code": %q, "EventId": "instance-event-1", "NotBefore": "21 Jan 2019 09:00:43 GMT", "State": "active"}]`, test.code),
+		}}
+		server := httptest.NewServer(imds)
+		source, err := NewAWSTerminationSource(server.URL, false, 10*time.Minute)
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.code, err)
+		}
+		state := source.GetState()
+		if state.PendingTermination != test.expectedTermination || state.NeedsReboot != test.expectedReboot {
+			t.Errorf("%s: expected PendingTermination %v and NeedsReboot %v, got %+v", test.code, test.expectedTermination, test.expectedReboot, state)
+		}
+	}
+}
+
+func TestAWSScheduledEventsAreUpcomingUntilLeadTime(t *testing.T) {
+	notBefore := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	notAfter := notBefore.Add(2 * time.Hour)
+	imds := &fakeIMDS{values: map[string]string{
+		awsLocalHostnamePath: "ip-10-0-0-1.ec2.internal",
+		awsScheduledEventsPath: fmt.Sprintf(`[{"Code": "system-reboot", "EventId": "instance-event-1", "NotBefore": %q, "NotAfter": %q, "State": "active"}]`,
+			notBefore.Format(awsScheduledEventLayout), notAfter.Format(awsScheduledEventLayout)),
+	}}
+	server := httptest.NewServer(imds)
+	defer server.Close()
+
+	source, err := NewAWSTerminationSource(server.URL, false, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := source.GetState()
+	if state.PendingTermination {
+		t.Fatalf("expected no pending termination ahead of the lead time, got %+v", state)
+	}
+	expected := MaintenanceWindow{Start: notBefore, End: notAfter, CanReschedule: true}
+	if window := state.UpcomingMaintenance; window == nil || !window.Start.Equal(expected.Start) || !window.End.Equal(expected.End) || window.CanReschedule != expected.CanReschedule {
+		t.Fatalf("expected upcoming maintenance %+v, got %+v", expected, window)
+	}
+
+	// The same event is a pending termination once it is due within the lead time.
+	source, err = NewAWSTerminationSource(server.URL, false, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state = source.GetState()
+	if !state.PendingTermination || !state.TerminationTime.Equal(notBefore) || !state.NeedsReboot || state.UpcomingMaintenance != nil {
+		t.Errorf("expected a pending reboot at %v, got %+v", notBefore, state)
+	}
+}
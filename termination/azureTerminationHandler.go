@@ -0,0 +1,250 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	azureInstancePath          = "/metadata/instance?api-version=2020-09-01"
+	azureScheduledEventsPath   = "/metadata/scheduledevents?api-version=2020-07-01"
+	azureMetadataHeader        = "Metadata"
+	azureEventPreempt          = "Preempt"
+	azureEventTerminate        = "Terminate"
+	azureEventReboot           = "Reboot"
+	azureEventRedeploy         = "Redeploy"
+	azureEventStatusScheduled  = "Scheduled"
+	azurePollInterval          = time.Second
+	azureMetadataClientTimeout = 5 * time.Second
+)
+
+// azureInstance is the subset of the instance metadata document used by the handler.
+type azureInstance struct {
+	Compute struct {
+		Name      string `json:"name"`
+		OSProfile struct {
+			ComputerName string `json:"computerName"`
+		} `json:"osProfile"`
+	} `json:"compute"`
+}
+
+// azureScheduledEvents is the document served at `/metadata/scheduledevents`.
+type azureScheduledEvents struct {
+	DocumentIncarnation int                   `json:"DocumentIncarnation"`
+	Events              []azureScheduledEvent `json:"Events"`
+}
+
+type azureScheduledEvent struct {
+	EventID     string   `json:"EventId"`
+	EventType   string   `json:"EventType"`
+	EventStatus string   `json:"EventStatus"`
+	Resources   []string `json:"Resources"`
+	NotBefore   string   `json:"NotBefore"`
+}
+
+// azureStartRequests is the document posted to `/metadata/scheduledevents` to approve events.
+type azureStartRequests struct {
+	StartRequests []azureStartRequest `json:"StartRequests"`
+}
+
+type azureStartRequest struct {
+	EventID string `json:"EventId"`
+}
+
+type azureTerminationSource struct {
+	sync.RWMutex
+	endpoint      string
+	client        *http.Client
+	vmName        string
+	state         NodeTerminationState
+	updateChannel chan NodeTerminationState
+	// pendingEvents holds the IDs of the scheduled events affecting the VM that still await approval.
+	pendingEvents []string
+	// stateEvents holds the IDs of the events `state` was derived from. Only these are approved once `state` is acknowledged.
+	stateEvents map[string]bool
+}
+
+// NewAzureTerminationSource returns a termination source that polls the Azure Scheduled Events API served at `endpoint`.
+// Events are approved once the handler has drained the node.
+func NewAzureTerminationSource(endpoint string) (NodeTerminationSource, error) {
+	ret := &azureTerminationSource{
+		endpoint:      strings.TrimSuffix(endpoint, "/"),
+		client:        &http.Client{Timeout: azureMetadataClientTimeout},
+		updateChannel: make(chan NodeTerminationState),
+	}
+	var instance azureInstance
+	if err := ret.do("GET", azureInstancePath, nil, &instance); err != nil {
+		return nil, err
+	}
+	ret.vmName = instance.Compute.Name
+	// Kubernetes nodes on Azure are named after the computer name, which differs from the VM name for scale sets.
+	ret.state.NodeName = strings.ToLower(instance.Compute.OSProfile.ComputerName)
+	// Check if a termination is already pending. This can happen if the termination watcher restarts.
+	if _, err := ret.refresh(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// do issues a request against the metadata service and decodes the response into `out` if it is not nil.
+func (a *azureTerminationSource) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewBuffer(b)
+	}
+	req, err := http.NewRequest(method, a.endpoint+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(azureMetadataHeader, "true")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code %d trying to %s %s", resp.StatusCode, method, path)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// refresh polls the scheduled events and updates the stored state. It returns true if the state changed.
+func (a *azureTerminationSource) refresh() (bool, error) {
+	var events azureScheduledEvents
+	if err := a.do("GET", azureScheduledEventsPath, nil, &events); err != nil {
+		return false, err
+	}
+	state := NodeTerminationState{NodeName: a.state.NodeName}
+	var pendingEvents []string
+	stateEvents := map[string]bool{}
+	for _, event := range events.Events {
+		if !a.affectsVM(event) {
+			continue
+		}
+		var needsReboot bool
+		switch event.EventType {
+		case azureEventPreempt, azureEventTerminate:
+		case azureEventReboot, azureEventRedeploy:
+			needsReboot = true
+		default:
+			// Freeze events pause the VM for a few seconds and do not need any handling.
+			continue
+		}
+		var terminationTime time.Time
+		if event.NotBefore != "" {
+			var err error
+			if terminationTime, err = time.Parse(http.TimeFormat, event.NotBefore); err != nil {
+				return false, fmt.Errorf("failed to parse start time of scheduled event %q: %v", event.EventID, err)
+			}
+		} else if a.state.PendingTermination {
+			// Events that have already started do not publish a start time. Keep the previously observed deadline.
+			terminationTime = a.state.TerminationTime
+		} else {
+			terminationTime = time.Now()
+		}
+		glog.V(4).Infof("Scheduled event %q of type %q with status %q not before %v", event.EventID, event.EventType, event.EventStatus, terminationTime)
+		setEarliestTermination(&state, terminationTime, needsReboot)
+		stateEvents[event.EventID] = true
+		if event.EventStatus == azureEventStatusScheduled {
+			pendingEvents = append(pendingEvents, event.EventID)
+		}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.pendingEvents = pendingEvents
+	if reflect.DeepEqual(state, a.state) {
+		return false, nil
+	}
+	a.state = state
+	a.stateEvents = stateEvents
+	return true, nil
+}
+
+func (a *azureTerminationSource) affectsVM(event azureScheduledEvent) bool {
+	for _, resource := range event.Resources {
+		if strings.EqualFold(resource, a.vmName) {
+			return true
+		}
+	}
+	return false
+}
+
+// AcknowledgeTermination approves the scheduled events backing `state` so that the platform can proceed without
+// waiting for the deadline. Events that showed up after `state` was published are left for their own state to be
+// handled.
+func (a *azureTerminationSource) AcknowledgeTermination(state NodeTerminationState) error {
+	a.RLock()
+	if !reflect.DeepEqual(state, a.state) {
+		a.RUnlock()
+		glog.V(4).Infof("Not approving scheduled events of an outdated state %+v", state)
+		return nil
+	}
+	req := azureStartRequests{}
+	for _, id := range a.pendingEvents {
+		if a.stateEvents[id] {
+			req.StartRequests = append(req.StartRequests, azureStartRequest{EventID: id})
+		}
+	}
+	a.RUnlock()
+	if len(req.StartRequests) == 0 {
+		return nil
+	}
+	glog.V(4).Infof("Approving scheduled events %v", req.StartRequests)
+	return a.do("POST", azureScheduledEventsPath, req, nil)
+}
+
+func (a *azureTerminationSource) WatchState() <-chan NodeTerminationState {
+	go wait.Forever(func() {
+		changed, err := a.refresh()
+		if err != nil {
+			glog.Errorf("Failed to get scheduled events for node %q - %v", a.state.NodeName, err)
+			return
+		}
+		if changed {
+			a.updateChannel <- a.GetState()
+		}
+	}, azurePollInterval)
+	return a.updateChannel
+}
+
+func (a *azureTerminationSource) GetState() NodeTerminationState {
+	a.RLock()
+	defer a.RUnlock()
+	return a.state
+}
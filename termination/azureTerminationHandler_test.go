@@ -0,0 +1,167 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeScheduledEvents is a local stand-in for the Azure instance metadata service.
+type fakeScheduledEvents struct {
+	sync.Mutex
+	events   azureScheduledEvents
+	approved []string
+}
+
+func (f *fakeScheduledEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(azureMetadataHeader) != "true" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	switch {
+	case r.URL.Path == "/metadata/instance":
+		w.Write([]byte(`{"compute": {"name": "aks-pool-vmss_3", "osProfile": {"computerName": "aks-pool-vmss000003"}}}`))
+	case r.URL.Path == "/metadata/scheduledevents" && r.Method == "GET":
+		json.NewEncoder(w).Encode(f.events)
+	case r.URL.Path == "/metadata/scheduledevents" && r.Method == "POST":
+		var req azureStartRequests
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, start := range req.StartRequests {
+			f.approved = append(f.approved, start.EventID)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestAzureTerminationSource(t *testing.T) {
+	imds := &fakeScheduledEvents{}
+	server := httptest.NewServer(imds)
+	defer server.Close()
+
+	source, err := NewAzureTerminationSource(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	azureSource := source.(*azureTerminationSource)
+	if state := source.GetState(); state.NodeName != "aks-pool-vmss000003" || state.PendingTermination {
+		t.Fatalf("unexpected initial state: %+v", state)
+	}
+
+	imds.Lock()
+	imds.events = azureScheduledEvents{
+		DocumentIncarnation: 2,
+		Events: []azureScheduledEvent{
+			{
+				EventID:     "freeze",
+				EventType:   "Freeze",
+				EventStatus: "Scheduled",
+				Resources:   []string{"aks-pool-vmss_3"},
+				NotBefore:   "Mon, 19 Sep 2016 18:20:00 GMT",
+			},
+			{
+				EventID:     "other-vm",
+				EventType:   "Preempt",
+				EventStatus: "Scheduled",
+				Resources:   []string{"aks-pool-vmss_4"},
+				NotBefore:   "Mon, 19 Sep 2016 18:21:00 GMT",
+			},
+			{
+				EventID:     "redeploy",
+				EventType:   "Redeploy",
+				EventStatus: "Scheduled",
+				Resources:   []string{"aks-pool-vmss_3"},
+				NotBefore:   "Mon, 19 Sep 2016 18:29:47 GMT",
+			},
+		},
+	}
+	imds.Unlock()
+	if _, err := azureSource.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	state := source.GetState()
+	expectedTermination := time.Date(2016, time.September, 19, 18, 29, 47, 0, time.UTC)
+	if !state.PendingTermination || !state.NeedsReboot || !state.TerminationTime.Equal(expectedTermination) {
+		t.Fatalf("expected a pending reboot at %v, got %+v", expectedTermination, state)
+	}
+
+	if err := azureSource.AcknowledgeTermination(state); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(imds.approved, []string{"redeploy"}) {
+		t.Fatalf("expected only the redeploy event to be approved, got %v", imds.approved)
+	}
+
+	// Events showing up later are not approved along with the state handled before.
+	imds.Lock()
+	imds.events.Events = append(imds.events.Events, azureScheduledEvent{
+		EventID:     "reboot",
+		EventType:   "Reboot",
+		EventStatus: "Scheduled",
+		Resources:   []string{"aks-pool-vmss_3"},
+		NotBefore:   "Mon, 19 Sep 2016 18:35:00 GMT",
+	})
+	imds.approved = nil
+	imds.Unlock()
+	if changed, err := azureSource.refresh(); err != nil || changed {
+		t.Fatalf("expected a later event not to change the state, got %v, %v", changed, err)
+	}
+	if err := azureSource.AcknowledgeTermination(state); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(imds.approved, []string{"redeploy"}) {
+		t.Fatalf("expected only the event the state was derived from to be approved, got %v", imds.approved)
+	}
+	outdated := state
+	outdated.TerminationTime = outdated.TerminationTime.Add(-time.Minute)
+	imds.Lock()
+	imds.approved = nil
+	imds.Unlock()
+	if err := azureSource.AcknowledgeTermination(outdated); err != nil {
+		t.Fatal(err)
+	}
+	if len(imds.approved) != 0 {
+		t.Fatalf("expected no event to be approved for an outdated state, got %v", imds.approved)
+	}
+	imds.Lock()
+	imds.events.Events = imds.events.Events[:3]
+	imds.Unlock()
+
+	// Started events do not need to be approved again and keep the previously observed deadline.
+	imds.Lock()
+	imds.events.Events[2].EventStatus = "Started"
+	imds.events.Events[2].NotBefore = ""
+	imds.Unlock()
+	if _, err := azureSource.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if state := source.GetState(); !state.TerminationTime.Equal(expectedTermination) {
+		t.Fatalf("expected termination time to remain %v, got %v", expectedTermination, state.TerminationTime)
+	}
+	if azureSource.pendingEvents != nil {
+		t.Fatalf("expected no events pending approval, got %v", azureSource.pendingEvents)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+type compositeTerminationSource struct {
+	sync.RWMutex
+	// names holds the names of the sub-sources in a stable order.
+	names         []string
+	sources       map[string]NodeTerminationSource
+	states        map[string]NodeTerminationState
+	state         NodeTerminationState
+	updateChannel chan NodeTerminationState
+	// notify coalesces merged state changes such that updates are published in order.
+	notify chan struct{}
+}
+
+// NewCompositeTerminationSource returns a termination source that merges the states of multiple named sources.
+// The merged state reports the earliest pending termination across all sources, and only requests a reboot
+// if every source reporting a pending termination does.
+func NewCompositeTerminationSource(sources map[string]NodeTerminationSource) (NodeTerminationSource, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no termination sources specified")
+	}
+	ret := &compositeTerminationSource{
+		sources:       sources,
+		states:        map[string]NodeTerminationState{},
+		updateChannel: make(chan NodeTerminationState),
+		notify:        make(chan struct{}, 1),
+	}
+	for name, source := range sources {
+		ret.names = append(ret.names, name)
+		ret.states[name] = source.GetState()
+	}
+	sort.Strings(ret.names)
+	ret.state = ret.merge()
+	return ret, nil
+}
+
+// merge combines the states of all sub-sources. It must be invoked with the lock held.
+func (c *compositeTerminationSource) merge() NodeTerminationState {
+	var merged NodeTerminationState
+	for _, name := range c.names {
+		state := c.states[name]
+		if merged.NodeName == "" {
+			merged.NodeName = state.NodeName
+		} else if state.NodeName != "" && state.NodeName != merged.NodeName {
+			glog.Warningf("Termination source %q reports node name %q instead of %q", name, state.NodeName, merged.NodeName)
+		}
+		merged.LiveMigration = merged.LiveMigration || state.LiveMigration
+		if window := state.UpcomingMaintenance; window != nil {
+			if merged.UpcomingMaintenance == nil || window.Start.Before(merged.UpcomingMaintenance.Start) {
+				merged.UpcomingMaintenance = window
+			}
+		}
+		if !state.PendingTermination {
+			continue
+		}
+		if !merged.PendingTermination {
+			merged.PendingTermination = true
+			merged.TerminationTime = state.TerminationTime
+			merged.ObservedTime = state.ObservedTime
+			merged.NeedsReboot = state.NeedsReboot
+			merged.WillBeStopped = state.WillBeStopped
+			merged.Source = name
+			merged.Reason = state.Reason
+			continue
+		}
+		if state.TerminationTime.Before(merged.TerminationTime) {
+			merged.TerminationTime = state.TerminationTime
+			merged.Source = name
+			merged.Reason = state.Reason
+		}
+		if !state.ObservedTime.IsZero() && (merged.ObservedTime.IsZero() || state.ObservedTime.Before(merged.ObservedTime)) {
+			merged.ObservedTime = state.ObservedTime
+		}
+		// Rebooting is pointless if any source expects the VM to go away.
+		merged.NeedsReboot = merged.NeedsReboot && state.NeedsReboot
+		merged.WillBeStopped = merged.WillBeStopped && state.WillBeStopped
+	}
+	return merged
+}
+
+func (c *compositeTerminationSource) update(name string, state NodeTerminationState) {
+	c.Lock()
+	defer c.Unlock()
+	c.states[name] = state
+	merged := c.merge()
+	if reflect.DeepEqual(merged, c.state) {
+		return
+	}
+	c.state = merged
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// AcknowledgeTermination forwards the acknowledgement to every sub-source that reports a pending termination.
+func (c *compositeTerminationSource) AcknowledgeTermination(state NodeTerminationState) error {
+	for _, name := range c.names {
+		acknowledger, ok := c.sources[name].(NodeTerminationAcknowledger)
+		if !ok {
+			continue
+		}
+		c.RLock()
+		subState := c.states[name]
+		c.RUnlock()
+		if !subState.PendingTermination {
+			continue
+		}
+		if err := acknowledger.AcknowledgeTermination(subState); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *compositeTerminationSource) WatchState() <-chan NodeTerminationState {
+	for _, name := range c.names {
+		updates := c.sources[name].WatchState()
+		if updates == nil {
+			// The source has nothing to watch.
+			continue
+		}
+		go func(name string, updates <-chan NodeTerminationState) {
+			for state := range updates {
+				glog.V(4).Infof("Termination source %q reported state %+v", name, state)
+				c.update(name, state)
+			}
+		}(name, updates)
+	}
+	go func() {
+		for range c.notify {
+			c.updateChannel <- c.GetState()
+		}
+	}()
+	return c.updateChannel
+}
+
+func (c *compositeTerminationSource) GetState() NodeTerminationState {
+	c.RLock()
+	defer c.RUnlock()
+	return c.state
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeSource struct {
+	state        NodeTerminationState
+	updates      chan NodeTerminationState
+	acknowledged []NodeTerminationState
+}
+
+func newFakeSource(state NodeTerminationState) *fakeSource {
+	return &fakeSource{state: state, updates: make(chan NodeTerminationState)}
+}
+
+func (f *fakeSource) WatchState() <-chan NodeTerminationState { return f.updates }
+func (f *fakeSource) GetState() NodeTerminationState          { return f.state }
+func (f *fakeSource) AcknowledgeTermination(state NodeTerminationState) error {
+	f.acknowledged = append(f.acknowledged, state)
+	return nil
+}
+
+func TestCompositeTerminationSource(t *testing.T) {
+	now := time.Now()
+	gce := newFakeSource(NodeTerminationState{NodeName: "node", PendingTermination: true, TerminationTime: now.Add(time.Hour), NeedsReboot: true})
+	trigger := newFakeSource(NodeTerminationState{NodeName: "node"})
+	source, err := NewCompositeTerminationSource(map[string]NodeTerminationSource{"gce": gce, "http": trigger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := source.GetState(); !state.PendingTermination || !state.NeedsReboot || state.Source != "gce" || !state.TerminationTime.Equal(now.Add(time.Hour)) {
+		t.Fatalf("unexpected initial state: %+v", state)
+	}
+	states := source.WatchState()
+
+	for _, test := range []struct {
+		desc          string
+		source        *fakeSource
+		update        NodeTerminationState
+		expectedState NodeTerminationState
+	}{
+		{
+			desc:   "earlier deadline without reboot",
+			source: trigger,
+			update: NodeTerminationState{NodeName: "node", PendingTermination: true, TerminationTime: now.Add(time.Minute), Reason: "MIG recreation"},
+			expectedState: NodeTerminationState{
+				NodeName:           "node",
+				PendingTermination: true,
+				TerminationTime:    now.Add(time.Minute),
+				Source:             "http",
+				Reason:             "MIG recreation",
+			},
+		},
+		{
+			desc:   "later deadline keeps the strictest action",
+			source: trigger,
+			update: NodeTerminationState{NodeName: "node", PendingTermination: true, TerminationTime: now.Add(2 * time.Hour), Reason: "MIG recreation"},
+			expectedState: NodeTerminationState{
+				NodeName:           "node",
+				PendingTermination: true,
+				TerminationTime:    now.Add(time.Hour),
+				Source:             "gce",
+			},
+		},
+		{
+			desc:          "remaining termination after cancellation",
+			source:        gce,
+			update:        NodeTerminationState{NodeName: "node"},
+			expectedState: NodeTerminationState{NodeName: "node", PendingTermination: true, TerminationTime: now.Add(2 * time.Hour), Source: "http", Reason: "MIG recreation"},
+		},
+	} {
+		test.source.state = test.update
+		test.source.updates <- test.update
+		select {
+		case state := <-states:
+			if state.PendingTermination != test.expectedState.PendingTermination ||
+				state.NeedsReboot != test.expectedState.NeedsReboot ||
+				state.Source != test.expectedState.Source ||
+				state.Reason != test.expectedState.Reason ||
+				!state.TerminationTime.Equal(test.expectedState.TerminationTime) {
+				t.Errorf("%s: expected state %+v, got %+v", test.desc, test.expectedState, state)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for a state update", test.desc)
+		}
+	}
+
+	if err := source.(NodeTerminationAcknowledger).AcknowledgeTermination(source.GetState()); err != nil {
+		t.Fatal(err)
+	}
+	if len(gce.acknowledged) != 0 || len(trigger.acknowledged) != 1 {
+		t.Fatalf("expected only the pending source to be acknowledged, got %v and %v", gce.acknowledged, trigger.acknowledged)
+	}
+}
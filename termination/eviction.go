@@ -15,112 +15,476 @@
 package termination
 
 import (
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 
 	"k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1beta1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/wait"
 	client "k8s.io/client-go/kubernetes"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	policyv1beta1 "k8s.io/client-go/kubernetes/typed/policy/v1beta1"
+	storagev1beta1 "k8s.io/client-go/kubernetes/typed/storage/v1beta1"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 )
 
 const (
 	systemNamespace = "kube-system"
 	eventReason     = "NodeTermination"
+	// pdbViolationReason is recorded on pods that were deleted in spite of their PodDisruptionBudget.
+	pdbViolationReason = "PodDisruptionBudgetViolated"
+	// evictionSkippedReason is recorded on pods that are not evicted.
+	evictionSkippedReason = "NodeTerminationEvictionSkipped"
+	// gracePeriodShortenedReason is recorded on pods that are given less time to exit than they request.
+	gracePeriodShortenedReason = "TerminationGracePeriodShortened"
 )
 
+var (
+	// evictionRetryInterval is the time to wait before retrying evictions refused by a PodDisruptionBudget.
+	evictionRetryInterval = 5 * time.Second
+	// errEvictionCancelled is returned for evictions abandoned because the pending termination was cancelled.
+	errEvictionCancelled = errors.New("eviction cancelled")
+)
+
+// PodEvictionOptions configures how pods are evicted from the node.
+type PodEvictionOptions struct {
+	// PDBForceDeleteThreshold is the time left before the deadline under which pods are deleted in spite of their PodDisruptionBudget.
+	PDBForceDeleteThreshold time.Duration
+	// MaxConcurrentEvictions bounds the number of pods being evicted at the same time.
+	MaxConcurrentEvictions int
+	// EvictionQPS is the maximum number of eviction and deletion requests sent to the API server per second.
+	EvictionQPS float32
+	// PriorityTiers are sorted by increasing priority. They take precedence over Phases if set.
+	PriorityTiers []ShutdownGracePeriodByPodPriority
+	// Phases default to DefaultEvictionPhases if neither Phases nor PriorityTiers are set.
+	Phases []EvictionPhase
+	// EvictDaemonSetPods evicts DaemonSet pods in the last tier. They are left running otherwise.
+	EvictDaemonSetPods bool
+	// Executor runs the exec pre-eviction hooks declared by pods. Exec hooks fail if nil.
+	Executor PodExecutor
+	// JustInTime delays the deletion of each pod until only its shutdown budget and the safety margin are left
+	// before the end of its tier. Pods are deleted as soon as their tier starts otherwise.
+	JustInTime bool
+	// SafetyMargin is the time by which just-in-time evictions are expected to complete ahead of the end of their tier.
+	SafetyMargin time.Duration
+	// ForceDeleteLeadTime is the time before the eviction deadline at which evicted pods that still exist are deleted with a
+	// grace period of 0. Pods outliving their eviction are left alone if 0.
+	ForceDeleteLeadTime time.Duration
+	// FinalizerAllowlist lists glob patterns of finalizers that are removed from pods deleted with a grace period of 0.
+	FinalizerAllowlist []string
+	// ReportNamespace is the namespace of the ConfigMaps drain reports are persisted in. Reports are only logged if empty.
+	ReportNamespace string
+}
+
 type podEvictionHandler struct {
-	client               corev1.CoreV1Interface
-	node                 string
-	recorder             record.EventRecorder
-	systemPodGracePeriod time.Duration
+	client       corev1.CoreV1Interface
+	policyClient policyv1beta1.PolicyV1beta1Interface
+	// storageClient tracks the volumes attached to the node.
+	storageClient storagev1beta1.StorageV1beta1Interface
+	node          string
+	recorder      record.EventRecorder
+	// pdbForceDeleteThreshold is the time left before the deadline under which pods are deleted in spite of their PodDisruptionBudget.
+	pdbForceDeleteThreshold time.Duration
+	// maxConcurrentEvictions bounds the number of pods being evicted at the same time.
+	maxConcurrentEvictions int
+	// rateLimiter throttles eviction and deletion requests sent to the API server.
+	rateLimiter flowcontrol.RateLimiter
+	// priorityTiers are sorted by increasing priority. Pods are grouped by phases if empty.
+	priorityTiers       []ShutdownGracePeriodByPodPriority
+	phases              []EvictionPhase
+	evictDaemonSetPods  bool
+	executor            PodExecutor
+	justInTime          bool
+	safetyMargin        time.Duration
+	forceDeleteLeadTime time.Duration
+	finalizerAllowlist  []string
+	// tracker follows the pods of the node while they are evicted.
+	tracker *podTracker
+	// report collects what is done to the pods of the node while they are evicted.
+	report *drainReporter
+	// evictedVolumes are the persistent volumes mounted by the pods evicted by the last call to EvictPods.
+	evictedVolumes map[string]bool
+	// reportNamespace is the namespace of the ConfigMaps drain reports are persisted in. Reports are only logged if empty.
+	reportNamespace string
 }
 
 // List all pods on the node
-// Evict all pods on the node not in kube-system namespace
+// Evict all pods on the node phase by phase
 // Return nil on success
-func NewPodEvictionHandler(node string, client *client.Clientset, recorder record.EventRecorder, systemPodGracePeriod time.Duration) PodEvictionHandler {
+// An error is returned if the priority tiers or eviction phases of `options` are invalid.
+func NewPodEvictionHandler(node string, client *client.Clientset, recorder record.EventRecorder, options PodEvictionOptions) (PodEvictionHandler, error) {
+	priorityTiers := append([]ShutdownGracePeriodByPodPriority(nil), options.PriorityTiers...)
+	if err := ValidatePriorityTiers(priorityTiers); err != nil {
+		return nil, err
+	}
+	phases := append([]EvictionPhase(nil), options.Phases...)
+	if len(phases) == 0 && len(priorityTiers) == 0 {
+		phases = DefaultEvictionPhases(defaultSystemPodGracePeriod)
+	}
+	if len(phases) > 0 {
+		if err := ValidateEvictionPhases(phases); err != nil {
+			return nil, err
+		}
+	}
 	return &podEvictionHandler{
-		client:               client.CoreV1(),
-		node:                 node,
-		recorder:             recorder,
-		systemPodGracePeriod: systemPodGracePeriod,
+		client:                  client.CoreV1(),
+		policyClient:            client.PolicyV1beta1(),
+		storageClient:           client.StorageV1beta1(),
+		node:                    node,
+		recorder:                recorder,
+		pdbForceDeleteThreshold: options.PDBForceDeleteThreshold,
+		maxConcurrentEvictions:  options.MaxConcurrentEvictions,
+		rateLimiter:             flowcontrol.NewTokenBucketRateLimiter(options.EvictionQPS, options.MaxConcurrentEvictions),
+		priorityTiers:           priorityTiers,
+		phases:                  phases,
+		evictDaemonSetPods:      options.EvictDaemonSetPods,
+		executor:                options.Executor,
+		justInTime:              options.JustInTime,
+		safetyMargin:            options.SafetyMargin,
+		forceDeleteLeadTime:     options.ForceDeleteLeadTime,
+		finalizerAllowlist:      options.FinalizerAllowlist,
+		reportNamespace:         options.ReportNamespace,
+	}, nil
+}
+
+func (p *podEvictionHandler) EvictPods(exclusions *PodExclusions, timeout time.Duration, stopCh <-chan struct{}) error {
+	start := time.Now()
+	if p.report == nil || !p.report.covers(start.Add(timeout)) {
+		p.report = newDrainReporter(p.node, start, start.Add(timeout))
 	}
+	p.evictedVolumes = map[string]bool{}
+	err := p.evictPods(exclusions, start, timeout, stopCh)
+	p.publishReport(p.report.complete(isStopped(stopCh), err))
+	return err
 }
 
-func (p *podEvictionHandler) EvictPods(excludePods map[string]string, timeout time.Duration) error {
-	options := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("spec.nodeName", string(p.node)).String()}
-	pods, err := p.client.Pods(metav1.NamespaceAll).List(options)
+func (p *podEvictionHandler) evictPods(exclusions *PodExclusions, start time.Time, timeout time.Duration, stopCh <-chan struct{}) error {
+	tracker, pods, err := newPodTracker(p.client, p.node)
 	if err != nil {
 		glog.V(2).Infof("Failed to list pods - %v", err)
 		return err
 	}
-	var systemPods, regularPods []v1.Pod
-	// Separate pods in kube-system namespace such that they can be evicted at the end.
-	// This is especially helpful in scenarios like reclaiming logs prior to node termination.
-	for _, pod := range pods.Items {
-		if ns, exists := excludePods[pod.Name]; !exists || ns != pod.Namespace {
-			if pod.Namespace == systemNamespace {
-				systemPods = append(systemPods, pod)
-			} else {
-				regularPods = append(regularPods, pod)
-			}
+	defer tracker.stop()
+	p.tracker = tracker
+	skipped, tiers, claims := p.planEvictions(pods, exclusions, timeout)
+	for _, skip := range skipped {
+		if skip.excluded {
+			glog.V(4).Infof("Pod %q in namespace %q is excluded from eviction", skip.pod.Name, skip.pod.Namespace)
+		} else {
+			glog.V(2).Infof("Not evicting pod %q in namespace %q: %s", skip.pod.Name, skip.pod.Namespace, skip.reason)
+			p.recorder.Eventf(&skip.pod, v1.EventTypeNormal, evictionSkippedReason, "Node %q is about to be terminated. Not evicting pod: %s.", p.node, skip.reason)
 		}
+		p.report.skipped(skip.pod, skip.reason)
 	}
-	// Evict regular pods first.
-	var gracePeriod int64
-	// Reserve time for system pods if regular pods have adequate time to exit gracefully.
-	if timeout >= 2*p.systemPodGracePeriod {
-		gracePeriod = int64(timeout.Seconds() - p.systemPodGracePeriod.Seconds())
+	for _, tier := range tiers {
+		p.report.assigned(tier.pods, tier.description)
 	}
-	deleteOptions := &metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod}
-	if err := p.deletePods(regularPods, deleteOptions); err != nil {
-		return err
+	// The plan is persisted right away since short terminations may not leave time for evictions to complete.
+	p.persistProgress()
+	// Tiers are evicted one after the other, each of them by the end of its grace period.
+	tierDeadline := start
+	var stragglers []v1.Pod
+	for _, tier := range tiers {
+		tierDeadline = tierDeadline.Add(tier.gracePeriod)
+		glog.V(4).Infof("Evicting %d %s within %v", len(tier.pods), tier.description, tier.gracePeriod)
+		remaining, err := p.deletePods(tier.pods, claims, int64(tier.gracePeriod.Seconds()), tierDeadline, stopCh)
+		if err != nil {
+			return err
+		}
+		if isStopped(stopCh) {
+			glog.V(4).Infof("Termination of node %q was cancelled. Not evicting remaining pods", p.node)
+			return nil
+		}
+		stragglers = append(stragglers, remaining...)
 	}
-	// Evict system pods.
-	gracePeriod = int64(p.systemPodGracePeriod.Seconds())
-	deleteOptions.GracePeriodSeconds = &gracePeriod
-	if err := p.deletePods(systemPods, deleteOptions); err != nil {
-		return err
+	if len(stragglers) > 0 && p.forceDeleteLeadTime > 0 {
+		glog.V(4).Infof("Deleting %d pods that outlived their eviction %v before the deadline", len(stragglers), p.forceDeleteLeadTime)
+		if err := p.forceDeleteStragglers(stragglers, start.Add(timeout), stopCh); err != nil {
+			return err
+		}
 	}
 	glog.V(4).Infof("Successfully evicted all pods from node %q", p.node)
 	return nil
 }
 
-func (p *podEvictionHandler) deletePods(pods []v1.Pod, deleteOptions *metav1.DeleteOptions) error {
+// skippedPod is a pod of the node that is not evicted.
+type skippedPod struct {
+	pod    v1.Pod
+	reason string
+	// excluded is set for pods excluded by the caller of EvictPods rather than by skipReason.
+	excluded bool
+}
+
+// planEvictions returns the pods among `pods` that must not be evicted, the tiers the other pods are evicted in
+// within `timeout`, and the persistent volume claims of these pods. Pods holding ReadWriteOnce volumes come first within their tier.
+func (p *podEvictionHandler) planEvictions(pods []v1.Pod, exclusions *PodExclusions, timeout time.Duration) ([]skippedPod, []evictionTier, volumeClaims) {
+	var (
+		skipped    []skippedPod
+		candidates []v1.Pod
+	)
 	for _, pod := range pods {
-		p.recorder.Eventf(&pod, v1.EventTypeWarning, eventReason, "Node %q is about to be terminated. Evicting pod prior to node termination.", p.node)
-		// Delete the pod with the specified timeout.
-		glog.V(4).Infof("About to delete pod %q in namespace %q within grace period %d seconds", pod.Name, pod.Namespace, *deleteOptions.GracePeriodSeconds)
-		if err := p.client.Pods(pod.Namespace).Delete(pod.Name, deleteOptions); err != nil {
-			glog.V(2).Infof("Failed to delete pod %q in namespace %q - %v", pod.Name, pod.Namespace, err)
-			return err
+		if exclusions.Excludes(pod) {
+			skipped = append(skipped, skippedPod{pod: pod, reason: "excluded from eviction", excluded: true})
+			continue
+		}
+		if reason := p.skipReason(pod); reason != "" {
+			skipped = append(skipped, skippedPod{pod: pod, reason: reason})
+			continue
 		}
+		candidates = append(candidates, pod)
+	}
+	claims := p.getClaims(candidates)
+	tiers := p.groupPods(candidates, timeout)
+	for i := range tiers {
+		tiers[i].pods = sortByVolumes(tiers[i].pods, claims)
+	}
+	return skipped, tiers, claims
+}
+
+// skipReason returns why `pod` must not be evicted, or an empty string if it must be evicted.
+// Pods are classified like `kubectl drain` does.
+func (p *podEvictionHandler) skipReason(pod v1.Pod) string {
+	if _, exists := pod.Annotations[v1.MirrorPodAnnotationKey]; exists {
+		return "static pods are managed by the kubelet and cannot be evicted"
+	}
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		return "pod already terminated"
 	}
+	if isDaemonSetPod(pod) && !p.evictDaemonSetPods {
+		return "DaemonSet pods would be recreated on the node"
+	}
+	return ""
+}
+
+// isDaemonSetPod returns true if `pod` is controlled by a DaemonSet.
+func isDaemonSetPod(pod v1.Pod) bool {
+	controller := metav1.GetControllerOf(&pod)
+	return controller != nil && controller.Kind == "DaemonSet"
+}
+
+// deletePods concurrently evicts `pods`, which mount `claims`, within the specified grace period once their pre-eviction hooks have completed.
+// Evictions refused by a PodDisruptionBudget are retried until `deadline` is close enough for the pods to be deleted regardless.
+// Deletions that have not been issued yet are dropped once `stopCh` is closed. It returns the evicted pods that still exist
+// at the end of the tier.
+func (p *podEvictionHandler) deletePods(pods []v1.Pod, claims volumeClaims, gracePeriod int64, deadline time.Time, stopCh <-chan struct{}) ([]v1.Pod, error) {
+	var (
+		lock    sync.Mutex
+		errs    []error
+		evicted []v1.Pod
+	)
+	workers := make(chan struct{}, p.maxConcurrentEvictions)
+	scheduler := newDeletionScheduler(stopCh)
+	for _, batch := range p.planDeletions(pods, gracePeriod, time.Now(), deadline) {
+		if batch.at.After(time.Now()) {
+			glog.V(4).Infof("Deferring eviction of %d pods until %v", len(batch.pods), batch.at)
+		}
+		scheduler.schedule(batch.at, func(pods []v1.Pod) func() {
+			return func() {
+				batchEvicted, batchErrs := p.evictBatch(pods, gracePeriod, deadline, workers, stopCh)
+				lock.Lock()
+				defer lock.Unlock()
+				evicted = append(evicted, batchEvicted...)
+				errs = append(errs, batchErrs...)
+			}
+		}(batch.pods))
+	}
+	scheduler.wait()
+	p.persistProgress()
+	p.recordVolumes(evicted, claims)
 	// wait for pods to be actually deleted since deletion is asynchronous & pods have a deletion grace period to exit gracefully.
+	// Pods were given grace periods ending by the end of the tier, which is as long as the next tier can be held back.
+	end := p.evictionEnd(deadline)
+	remaining, err := p.waitForPodsNotFound(evicted, time.Until(end), stopCh)
+	if isStopped(stopCh) {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	for _, pod := range remaining {
+		glog.Errorf("Pod %q/%q did not get deleted by %v: %v", pod.Namespace, pod.Name, end, err)
+	}
+	p.report.finished(evicted, true)
+	p.report.finished(remaining, false)
+	return remaining, utilerrors.NewAggregate(errs)
+}
+
+// evictBatch evicts `pods`, using up to `workers` evictions at once. Pods declaring a pre-eviction hook are evicted
+// once their own hook completed, without holding back the other pods. Pods are not evicted anymore once `stopCh` is
+// closed. It returns the pods that were evicted and the errors met evicting the other ones.
+func (p *podEvictionHandler) evictBatch(pods []v1.Pod, gracePeriod int64, deadline time.Time, workers chan struct{}, stopCh <-chan struct{}) ([]v1.Pod, []error) {
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		errs    []error
+		evicted []v1.Pod
+	)
+	// Neither hooks, deferred deletions nor refused evictions may let pods outlive the deadline.
+	end := p.evictionEnd(deadline)
+issue:
 	for _, pod := range pods {
-		if err := p.waitForPodNotFound(pod.Name, pod.Namespace, time.Duration(*deleteOptions.GracePeriodSeconds)*time.Second); err != nil {
-			glog.Errorf("Pod %q/%q did not get deleted within grace period %d seconds: %v", pod.Namespace, pod.Name, *deleteOptions.GracePeriodSeconds, err)
+		hook := p.preEvictionHookOf(pod)
+		if hook == nil {
+			// Pods are evicted in order as workers become available.
+			select {
+			case workers <- struct{}{}:
+			case <-stopCh:
+				glog.V(4).Infof("Termination of node %q was cancelled. Not evicting remaining pods", p.node)
+				break issue
+			}
 		}
+		wg.Add(1)
+		go func(pod v1.Pod, hook *preEvictionHook) {
+			defer wg.Done()
+			if hook != nil {
+				p.runPreEvictionHookUntil(pod, hook, deadline)
+				select {
+				case workers <- struct{}{}:
+				case <-stopCh:
+					glog.V(4).Infof("Termination of node %q was cancelled. Not evicting pod %q in namespace %q", p.node, pod.Name, pod.Namespace)
+					return
+				}
+			}
+			p.recorder.Eventf(&pod, v1.EventTypeWarning, eventReason, "Node %q is about to be terminated. Evicting pod prior to node termination.", p.node)
+			err := p.evictPod(pod, gracePeriod, end, deadline, workers, stopCh)
+			lock.Lock()
+			defer lock.Unlock()
+			if err == errEvictionCancelled {
+				glog.V(4).Infof("Termination of node %q was cancelled. Not evicting pod %q in namespace %q", p.node, pod.Name, pod.Namespace)
+				return
+			}
+			if err != nil {
+				glog.V(2).Infof("Failed to delete pod %q in namespace %q - %v", pod.Name, pod.Namespace, err)
+				p.report.failed(pod, err)
+				errs = append(errs, err)
+				return
+			}
+			evicted = append(evicted, pod)
+		}(pod, hook)
 	}
-	return nil
+	wg.Wait()
+	return evicted, errs
 }
 
-// waitForPodNotFound returns an error if it takes too long for the pod to fully terminate.
-func (p *podEvictionHandler) waitForPodNotFound(podName, ns string, timeout time.Duration) error {
-	return wait.PollImmediate(time.Second, timeout, func() (bool, error) {
-		_, err := p.client.Pods(ns).Get(podName, metav1.GetOptions{})
-		if apierrs.IsNotFound(err) {
-			return true, nil // done
+// podGracePeriod returns the grace period requested by `pod`, unless it exceeds `maxGracePeriod`.
+// An event is recorded on pods whose request cannot be satisfied.
+func (p *podEvictionHandler) podGracePeriod(pod v1.Pod, maxGracePeriod int64) int64 {
+	gracePeriod := requestedGracePeriod(pod, maxGracePeriod)
+	if requested := pod.Spec.TerminationGracePeriodSeconds; requested != nil && *requested > gracePeriod {
+		glog.V(2).Infof("Shortening grace period of pod %q in namespace %q from %d to %d seconds", pod.Name, pod.Namespace, *requested, gracePeriod)
+		p.recorder.Eventf(&pod, v1.EventTypeWarning, gracePeriodShortenedReason, "Node %q is about to be terminated. Pod requests a grace period of %d seconds but only %d seconds are available.", p.node, *requested, gracePeriod)
+	}
+	return gracePeriod
+}
+
+// requestedGracePeriod returns the grace period requested by `pod`, unless it exceeds `maxGracePeriod`.
+func requestedGracePeriod(pod v1.Pod, maxGracePeriod int64) int64 {
+	if requested := pod.Spec.TerminationGracePeriodSeconds; requested != nil && *requested < maxGracePeriod {
+		return *requested
+	}
+	return maxGracePeriod
+}
+
+// evictionEnd returns the time by which the pods of a tier ending at `deadline` must be gone.
+func (p *podEvictionHandler) evictionEnd(deadline time.Time) time.Time {
+	if p.justInTime {
+		return deadline.Add(-p.safetyMargin)
+	}
+	return deadline
+}
+
+// gracePeriodAt shortens `gracePeriod` such that pods deleted at `at` are gone by `end`.
+func gracePeriodAt(gracePeriod int64, at, end time.Time) int64 {
+	if remaining := int64(end.Sub(at).Round(time.Second).Seconds()); remaining < gracePeriod {
+		if remaining < 0 {
+			return 0
 		}
-		if err != nil {
-			return true, err // stop wait with error
+		return remaining
+	}
+	return gracePeriod
+}
+
+// evictPod evicts `pod` through the Eviction API such that PodDisruptionBudgets are honored. The pod is given
+// `gracePeriod`, shortened such that it is gone by `end`. It is deleted if its PodDisruptionBudget still refuses the
+// eviction once less than `pdbForceDeleteThreshold` is left before `deadline`.
+// evictPod is called holding one of `workers`, which it releases while waiting to retry refused evictions such that
+// other pods are evicted meanwhile. Refused evictions are not retried anymore once `stopCh` is closed, in which case
+// errEvictionCancelled is returned.
+func (p *podEvictionHandler) evictPod(pod v1.Pod, gracePeriod int64, end, deadline time.Time, workers chan struct{}, stopCh <-chan struct{}) error {
+	held := true
+	defer func() {
+		if held {
+			<-workers
+		}
+	}()
+	gracePeriod = p.podGracePeriod(pod, gracePeriodAt(gracePeriod, time.Now(), end))
+	for {
+		if isStopped(stopCh) {
+			return errEvictionCancelled
+		}
+		// Delete the pod with the specified timeout.
+		glog.V(4).Infof("About to delete pod %q in namespace %q within grace period %d seconds", pod.Name, pod.Namespace, gracePeriod)
+		p.report.issued(pod, gracePeriod)
+		deleteOptions := &metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod}
+		p.rateLimiter.Accept()
+		err := p.policyClient.Evictions(pod.Namespace).Evict(&policy.Eviction{
+			ObjectMeta:    metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+			DeleteOptions: deleteOptions,
+		})
+		if err == nil || apierrs.IsNotFound(err) {
+			return nil
+		}
+		// Evictions that would violate a PodDisruptionBudget are refused with `429 Too Many Requests`.
+		if !apierrs.IsTooManyRequests(err) {
+			return err
+		}
+		if isStopped(stopCh) {
+			return errEvictionCancelled
+		}
+		if time.Until(deadline) < p.pdbForceDeleteThreshold {
+			return p.forceDeletePod(pod, deleteOptions)
 		}
-		return false, nil
-	})
+		glog.V(4).Infof("Eviction of pod %q in namespace %q refused by its PodDisruptionBudget. Retrying in %v: %v", pod.Name, pod.Namespace, evictionRetryInterval, err)
+		<-workers
+		held = false
+		select {
+		case <-stopCh:
+			return errEvictionCancelled
+		case <-time.After(evictionRetryInterval):
+		}
+		select {
+		case workers <- struct{}{}:
+			held = true
+		case <-stopCh:
+			return errEvictionCancelled
+		}
+		// Do not let the pod outlive the deadline because evictions were retried.
+		gracePeriod = gracePeriodAt(gracePeriod, time.Now(), end)
+	}
+}
+
+// forceDeletePod deletes `pod` without consulting its PodDisruptionBudget.
+func (p *podEvictionHandler) forceDeletePod(pod v1.Pod, deleteOptions *metav1.DeleteOptions) error {
+	glog.V(2).Infof("Deleting pod %q in namespace %q in spite of its PodDisruptionBudget", pod.Name, pod.Namespace)
+	p.recorder.Eventf(&pod, v1.EventTypeWarning, pdbViolationReason, "Node %q is about to be terminated. Deleting pod in spite of its PodDisruptionBudget.", p.node)
+	p.report.forced(pod, "deleted in spite of its PodDisruptionBudget")
+	p.rateLimiter.Accept()
+	err := p.client.Pods(pod.Namespace).Delete(pod.Name, deleteOptions)
+	if apierrs.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// waitForPodsNotFound waits for all `pods` to fully terminate. It returns the pods that still exist after `timeout`,
+// or once `stopCh` is closed.
+func (p *podEvictionHandler) waitForPodsNotFound(pods []v1.Pod, timeout time.Duration, stopCh <-chan struct{}) ([]v1.Pod, error) {
+	if remaining := p.tracker.waitForDeletion(pods, timeout, stopCh); len(remaining) > 0 {
+		return remaining, wait.ErrWaitTimeout
+	}
+	return nil, nil
 }
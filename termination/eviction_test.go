@@ -15,29 +15,132 @@
 package termination
 
 import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
 	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	policyv1beta1 "k8s.io/client-go/kubernetes/typed/policy/v1beta1"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 )
 
 type pod struct {
 	name, namespace, nodeName string
+	uid                       types.UID
+	annotations               map[string]string
+	priority                  *int32
+	terminationGracePeriod    *int64
+	// claim is the name of a persistent volume claim mounted by the pod, if any.
+	claim      string
+	containers []string
+	podIP      string
 }
 
 func makePod(p pod) v1.Pod {
-	return v1.Pod{
+	ret := v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      p.name,
-			Namespace: p.namespace,
+			Name:        p.name,
+			Namespace:   p.namespace,
+			UID:         p.uid,
+			Annotations: p.annotations,
 		},
 		Spec: v1.PodSpec{
-			NodeName: p.nodeName,
+			NodeName:                      p.nodeName,
+			Priority:                      p.priority,
+			TerminationGracePeriodSeconds: p.terminationGracePeriod,
 		},
+		Status: v1.PodStatus{
+			PodIP: p.podIP,
+		},
+	}
+	if p.claim != "" {
+		ret.Spec.Volumes = []v1.Volume{{
+			Name:         "data",
+			VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: p.claim}},
+		}}
 	}
+	for _, container := range p.containers {
+		ret.Spec.Containers = append(ret.Spec.Containers, v1.Container{Name: container})
+	}
+	return ret
+}
+
+// fakeEvictions deletes evicted pods, unless their namespace is protected by a PodDisruptionBudget.
+// The fake clientset does not implement evictions.
+type fakeEvictions struct {
+	policyv1beta1.EvictionInterface
+	client              corev1.CoreV1Interface
+	protectedNamespaces map[string]bool
+	// latency is the time taken by each eviction request.
+	latency time.Duration
+
+	lock sync.Mutex
+	// refusals is the number of times the eviction of each pod is refused, by name, before it is accepted.
+	refusals map[string]int
+	// attempts is the number of evictions requested for each pod, by name.
+	attempts map[string]int
+	// stuck are the pods, by name, whose evictions are accepted but which never get deleted.
+	stuck map[string]bool
+}
+
+func (f *fakeEvictions) Evict(eviction *policy.Eviction) error {
+	time.Sleep(f.latency)
+	f.lock.Lock()
+	f.attempts[eviction.Name]++
+	f.lock.Unlock()
+	if f.protectedNamespaces[eviction.Namespace] || f.refuse(eviction.Name) {
+		return apierrs.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+	}
+	if f.stuck[eviction.Name] {
+		return nil
+	}
+	return f.client.Pods(eviction.Namespace).Delete(eviction.Name, eviction.DeleteOptions)
+}
+
+func (f *fakeEvictions) refuse(name string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.refusals[name] == 0 {
+		return false
+	}
+	f.refusals[name]--
+	return true
+}
+
+type fakePolicyClient struct {
+	policyv1beta1.PolicyV1beta1Interface
+	evictions *fakeEvictions
+}
+
+func (f *fakePolicyClient) Evictions(namespace string) policyv1beta1.EvictionInterface {
+	return f.evictions
+}
+
+func newFakePolicyClient(client corev1.CoreV1Interface, protectedNamespaces ...string) *fakePolicyClient {
+	evictions := &fakeEvictions{client: client, protectedNamespaces: map[string]bool{}, refusals: map[string]int{}, attempts: map[string]int{}, stuck: map[string]bool{}}
+	for _, namespace := range protectedNamespaces {
+		evictions.protectedNamespaces[namespace] = true
+	}
+	return &fakePolicyClient{evictions: evictions}
+}
+
+func defaultEvictionPhases(t *testing.T) []EvictionPhase {
+	phases := DefaultEvictionPhases(time.Second)
+	if err := ValidateEvictionPhases(phases); err != nil {
+		t.Fatal(err)
+	}
+	return phases
 }
 
 func TestEvictions(t *testing.T) {
@@ -84,13 +187,19 @@ func TestEvictions(t *testing.T) {
 		kubeClientset := fakekubeclientset.NewSimpleClientset(&podList)
 		recorder := record.NewFakeRecorder(20)
 		evictionHandler := &podEvictionHandler{
-			client:               kubeClientset.CoreV1(),
-			node:                 "localhost",
-			recorder:             recorder,
-			systemPodGracePeriod: 1,
+			client:                 kubeClientset.CoreV1(),
+			policyClient:           newFakePolicyClient(kubeClientset.CoreV1()),
+			node:                   "localhost",
+			recorder:               recorder,
+			phases:                 defaultEvictionPhases(t),
+			maxConcurrentEvictions: 1,
+			rateLimiter:            flowcontrol.NewFakeAlwaysRateLimiter(),
+		}
+		exclusions, err := NewPodExclusions([]types.NamespacedName{{Name: test.excludedPod.name, Namespace: test.excludedPod.namespace}}, nil, "", "")
+		if err != nil {
+			t.Fatal(err)
 		}
-		excludePods := map[string]string{test.excludedPod.name: test.excludedPod.namespace}
-		evictionHandler.EvictPods(excludePods, 30 /* timeout */)
+		evictionHandler.EvictPods(exclusions, 30 /* timeout */, nil)
 		options := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("spec.nodeName", string("localhost")).String()}
 		pods, err := kubeClientset.CoreV1().Pods(metav1.NamespaceAll).List(options)
 		if err != nil {
@@ -102,3 +211,324 @@ func TestEvictions(t *testing.T) {
 		}
 	}
 }
+
+func TestEvictionsDeletePodsProtectedByPDBNearDeadline(t *testing.T) {
+	podList := v1.PodList{Items: []v1.Pod{
+		makePod(pod{name: "foo", namespace: "default", nodeName: "localhost"}),
+		makePod(pod{name: "bar", namespace: "protected", nodeName: "localhost"}),
+	}}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&podList)
+	recorder := record.NewFakeRecorder(20)
+	evictionHandler := &podEvictionHandler{
+		client:                  kubeClientset.CoreV1(),
+		policyClient:            newFakePolicyClient(kubeClientset.CoreV1(), "protected"),
+		node:                    "localhost",
+		recorder:                recorder,
+		pdbForceDeleteThreshold: time.Minute,
+		maxConcurrentEvictions:  1,
+		phases:                  defaultEvictionPhases(t),
+		rateLimiter:             flowcontrol.NewFakeAlwaysRateLimiter(),
+	}
+	if err := evictionHandler.EvictPods(nil, 30*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	pods, err := kubeClientset.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 0 {
+		t.Fatalf("expected all pods to be deleted, found %d remaining", len(pods.Items))
+	}
+	var violations int
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, pdbViolationReason) {
+			violations++
+		}
+	}
+	if violations != 1 {
+		t.Fatalf("expected a single pod to be deleted in spite of its PodDisruptionBudget, got %d", violations)
+	}
+}
+
+func TestRefusedEvictionsAreRetried(t *testing.T) {
+	defer func(interval time.Duration) { evictionRetryInterval = interval }(evictionRetryInterval)
+	evictionRetryInterval = 200 * time.Millisecond
+	podList := v1.PodList{Items: []v1.Pod{makePod(pod{name: "web", namespace: "default", nodeName: "localhost"})}}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&podList)
+	policyClient := newFakePolicyClient(kubeClientset.CoreV1())
+	policyClient.evictions.refusals["web"] = 2
+	recorder := record.NewFakeRecorder(20)
+	evictionHandler := &podEvictionHandler{
+		client:                  kubeClientset.CoreV1(),
+		policyClient:            policyClient,
+		node:                    "localhost",
+		recorder:                recorder,
+		pdbForceDeleteThreshold: time.Second,
+		maxConcurrentEvictions:  1,
+		phases:                  defaultEvictionPhases(t),
+		rateLimiter:             flowcontrol.NewFakeAlwaysRateLimiter(),
+	}
+	if err := evictionHandler.EvictPods(nil, 5*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if attempts := policyClient.evictions.attempts["web"]; attempts != 3 {
+		t.Errorf("expected the eviction to be retried until accepted, got %d attempts", attempts)
+	}
+	if _, err := kubeClientset.CoreV1().Pods("default").Get("web", metav1.GetOptions{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the pod to be evicted, got %v", err)
+	}
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.Contains(event, pdbViolationReason) {
+			t.Errorf("expected the pod not to be deleted in spite of its PodDisruptionBudget, got %q", event)
+		}
+	}
+}
+
+func TestRefusedEvictionsAreRetriedUntilThreshold(t *testing.T) {
+	defer func(interval time.Duration) { evictionRetryInterval = interval }(evictionRetryInterval)
+	evictionRetryInterval = 300 * time.Millisecond
+	podList := v1.PodList{Items: []v1.Pod{makePod(pod{name: "bar", namespace: "protected", nodeName: "localhost"})}}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&podList)
+	policyClient := newFakePolicyClient(kubeClientset.CoreV1(), "protected")
+	recorder := record.NewFakeRecorder(20)
+	evictionHandler := &podEvictionHandler{
+		client:                  kubeClientset.CoreV1(),
+		policyClient:            policyClient,
+		node:                    "localhost",
+		recorder:                recorder,
+		pdbForceDeleteThreshold: time.Second,
+		maxConcurrentEvictions:  1,
+		phases:                  defaultEvictionPhases(t),
+		rateLimiter:             flowcontrol.NewFakeAlwaysRateLimiter(),
+	}
+	start := time.Now()
+	if err := evictionHandler.EvictPods(nil, 3*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The pod is only deleted once less than the threshold is left before the deadline.
+	if elapsed := time.Since(start); elapsed < 2*time.Second-evictionRetryInterval {
+		t.Errorf("expected the eviction to be retried until the threshold, pod was deleted after %v", elapsed)
+	}
+	if attempts := policyClient.evictions.attempts["bar"]; attempts < 2 {
+		t.Errorf("expected the eviction to be retried, got %d attempts", attempts)
+	}
+	if _, err := kubeClientset.CoreV1().Pods("protected").Get("bar", metav1.GetOptions{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the pod to be deleted, got %v", err)
+	}
+	var violations int
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, pdbViolationReason) {
+			violations++
+		}
+	}
+	if violations != 1 {
+		t.Errorf("expected the pod to be deleted in spite of its PodDisruptionBudget, got %d violations", violations)
+	}
+}
+
+func TestEvictionsStopRetryingOnceCancelled(t *testing.T) {
+	podList := v1.PodList{Items: []v1.Pod{makePod(pod{name: "bar", namespace: "protected", nodeName: "localhost"})}}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&podList)
+	recorder := record.NewFakeRecorder(20)
+	evictionHandler := &podEvictionHandler{
+		client:                  kubeClientset.CoreV1(),
+		policyClient:            newFakePolicyClient(kubeClientset.CoreV1(), "protected"),
+		node:                    "localhost",
+		recorder:                recorder,
+		pdbForceDeleteThreshold: 10 * time.Second,
+		maxConcurrentEvictions:  1,
+		phases:                  defaultEvictionPhases(t),
+		rateLimiter:             flowcontrol.NewFakeAlwaysRateLimiter(),
+	}
+	stopCh := make(chan struct{})
+	time.AfterFunc(500*time.Millisecond, func() { close(stopCh) })
+	start := time.Now()
+	if err := evictionHandler.EvictPods(nil, 22*time.Second, stopCh); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected evictions to stop once cancelled, took %v", elapsed)
+	}
+	if _, err := kubeClientset.CoreV1().Pods("protected").Get("bar", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the protected pod not to be deleted: %v", err)
+	}
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.Contains(event, pdbViolationReason) {
+			t.Errorf("expected no pod to be deleted in spite of its PodDisruptionBudget, got %q", event)
+		}
+	}
+}
+
+func TestRefusedEvictionsDoNotHoldBackOtherPods(t *testing.T) {
+	defer func(interval time.Duration) { evictionRetryInterval = interval }(evictionRetryInterval)
+	evictionRetryInterval = 600 * time.Millisecond
+	podList := v1.PodList{Items: []v1.Pod{
+		makePod(pod{name: "blocked", namespace: "protected", nodeName: "localhost"}),
+		makePod(pod{name: "web", namespace: "default", nodeName: "localhost"}),
+		makePod(pod{name: "db", namespace: "default", nodeName: "localhost"}),
+	}}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&podList)
+	policyClient := newFakePolicyClient(kubeClientset.CoreV1(), "protected")
+	policyClient.evictions.refusals["db"] = 1
+	evictionHandler := &podEvictionHandler{
+		client:                  kubeClientset.CoreV1(),
+		policyClient:            policyClient,
+		node:                    "localhost",
+		recorder:                record.NewFakeRecorder(20),
+		pdbForceDeleteThreshold: time.Second,
+		maxConcurrentEvictions:  1,
+		phases:                  defaultEvictionPhases(t),
+		rateLimiter:             flowcontrol.NewFakeAlwaysRateLimiter(),
+	}
+	start := time.Now()
+	// Regular pods are given the whole 3 seconds since there are no system pods.
+	if err := evictionHandler.EvictPods(nil, 3*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	pods := map[string]PodDrainReport{}
+	for _, pod := range evictionHandler.report.complete(false, nil).Pods {
+		pods[pod.Name] = pod
+	}
+	if issued := pods["web"].Issued; issued == nil || issued.Sub(start) > 500*time.Millisecond {
+		t.Errorf("expected the pod to be evicted while the eviction of another pod is refused, got %+v", pods["web"])
+	}
+	if db := pods["db"]; db.GracePeriodSeconds == nil || *db.GracePeriodSeconds >= 3 {
+		t.Errorf("expected the grace period of the retried eviction to be shortened to the time left, got %+v", db)
+	}
+	if len(pods["blocked"].ForceReasons) != 1 {
+		t.Errorf("expected the blocked pod to be deleted in spite of its PodDisruptionBudget, got %+v", pods["blocked"])
+	}
+}
+
+func TestEvictionsAreConcurrent(t *testing.T) {
+	var podList v1.PodList
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		podList.Items = append(podList.Items, makePod(pod{name: name, namespace: "default", nodeName: "localhost"}))
+	}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&podList)
+	policyClient := newFakePolicyClient(kubeClientset.CoreV1())
+	policyClient.evictions.latency = 500 * time.Millisecond
+	evictionHandler := &podEvictionHandler{
+		client:                 kubeClientset.CoreV1(),
+		policyClient:           policyClient,
+		node:                   "localhost",
+		recorder:               record.NewFakeRecorder(20),
+		maxConcurrentEvictions: 3,
+		rateLimiter:            flowcontrol.NewFakeAlwaysRateLimiter(),
+		phases:                 defaultEvictionPhases(t),
+	}
+	// Six pods evicted three at a time take two rounds of eviction requests.
+	start := time.Now()
+	if err := evictionHandler.EvictPods(nil, 30*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= 3*policyClient.evictions.latency {
+		t.Fatalf("expected evictions to run concurrently, took %v", elapsed)
+	}
+	pods, err := kubeClientset.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 0 {
+		t.Fatalf("expected all pods to be deleted, found %d remaining", len(pods.Items))
+	}
+}
+
+func TestEvictionsSkipPods(t *testing.T) {
+	isController := true
+	daemonSetPod := makePod(pod{name: "fluentd", namespace: "kube-system", nodeName: "localhost"})
+	daemonSetPod.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "fluentd", Controller: &isController}}
+	mirrorPod := makePod(pod{name: "kube-proxy", namespace: "kube-system", nodeName: "localhost", annotations: map[string]string{v1.MirrorPodAnnotationKey: "hash"}})
+	succeededPod := makePod(pod{name: "job", namespace: "default", nodeName: "localhost"})
+	succeededPod.Status.Phase = v1.PodSucceeded
+	regularPod := makePod(pod{name: "web", namespace: "default", nodeName: "localhost"})
+
+	for _, test := range []struct {
+		evictDaemonSetPods bool
+		remainingPods      []string
+	}{
+		{
+			remainingPods: []string{"fluentd", "job", "kube-proxy"},
+		},
+		{
+			evictDaemonSetPods: true,
+			remainingPods:      []string{"job", "kube-proxy"},
+		},
+	} {
+		podList := v1.PodList{Items: []v1.Pod{daemonSetPod, mirrorPod, succeededPod, regularPod}}
+		kubeClientset := fakekubeclientset.NewSimpleClientset(&podList)
+		recorder := record.NewFakeRecorder(20)
+		evictionHandler := &podEvictionHandler{
+			client:                 kubeClientset.CoreV1(),
+			policyClient:           newFakePolicyClient(kubeClientset.CoreV1()),
+			node:                   "localhost",
+			recorder:               recorder,
+			maxConcurrentEvictions: 1,
+			rateLimiter:            flowcontrol.NewFakeAlwaysRateLimiter(),
+			phases:                 defaultEvictionPhases(t),
+			evictDaemonSetPods:     test.evictDaemonSetPods,
+		}
+		if err := evictionHandler.EvictPods(nil, 30*time.Second, nil); err != nil {
+			t.Fatal(err)
+		}
+		pods, err := kubeClientset.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var remainingPods []string
+		for _, pod := range pods.Items {
+			remainingPods = append(remainingPods, pod.Name)
+		}
+		sort.Strings(remainingPods)
+		if !reflect.DeepEqual(remainingPods, test.remainingPods) {
+			t.Errorf("expected pods %v to remain, got %v", test.remainingPods, remainingPods)
+		}
+		var skipped int
+		for len(recorder.Events) > 0 {
+			if strings.Contains(<-recorder.Events, evictionSkippedReason) {
+				skipped++
+			}
+		}
+		if skipped != len(test.remainingPods) {
+			t.Errorf("expected %d pods to be reported as skipped, got %d", len(test.remainingPods), skipped)
+		}
+	}
+}
+
+func TestEvictionsHonorTerminationGracePeriod(t *testing.T) {
+	recorder := record.NewFakeRecorder(20)
+	evictionHandler := &podEvictionHandler{
+		node:     "localhost",
+		recorder: recorder,
+	}
+	for _, test := range []struct {
+		requested         *int64
+		expected          int64
+		expectedShortened bool
+	}{
+		{requested: nil, expected: 60},
+		{requested: int64Ptr(10), expected: 10},
+		{requested: int64Ptr(300), expected: 60, expectedShortened: true},
+	} {
+		pod := makePod(pod{name: "web", namespace: "default", nodeName: "localhost"})
+		pod.Spec.TerminationGracePeriodSeconds = test.requested
+		if actual := evictionHandler.podGracePeriod(pod, 60); actual != test.expected {
+			t.Errorf("expected a grace period of %d seconds, got %d", test.expected, actual)
+		}
+		var shortened bool
+		for len(recorder.Events) > 0 {
+			shortened = shortened || strings.Contains(<-recorder.Events, gracePeriodShortenedReason)
+		}
+		if shortened != test.expectedShortened {
+			t.Errorf("expected an event about the shortened grace period to be %v, got %v", test.expectedShortened, shortened)
+		}
+	}
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
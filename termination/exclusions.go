@@ -0,0 +1,90 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"fmt"
+	"path"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// PodExclusions identifies pods that must not be evicted when the node is terminated.
+type PodExclusions struct {
+	// pods are the `namespace/name` keys of excluded pods.
+	pods sets.String
+	// namespaces are glob patterns matching the namespaces of excluded pods.
+	namespaces []string
+	// selector matches the labels of excluded pods. Nil if pods are not excluded by labels.
+	selector labels.Selector
+	// annotation excludes pods on which it is set to "true".
+	annotation string
+}
+
+// NewPodExclusions returns exclusions matching `pods`, pods in namespaces matching any of the glob patterns in `namespaces`, pods matching the label `selector` unless it is
+// empty, and pods on which `annotation` is set to "true" unless it is empty.
+func NewPodExclusions(pods []types.NamespacedName, namespaces []string, selector, annotation string) (*PodExclusions, error) {
+	ret := &PodExclusions{
+		pods:       sets.NewString(),
+		namespaces: namespaces,
+		annotation: annotation,
+	}
+	for _, pod := range pods {
+		ret.ExcludePod(pod.Name, pod.Namespace)
+	}
+	for _, pattern := range namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern %q: %v", pattern, err)
+		}
+	}
+	if selector != "" {
+		var err error
+		if ret.selector, err = labels.Parse(selector); err != nil {
+			return nil, fmt.Errorf("invalid pod selector %q: %v", selector, err)
+		}
+	}
+	return ret, nil
+}
+
+// ExcludePod excludes the pod named `name` in `namespace`.
+func (e *PodExclusions) ExcludePod(name, namespace string) {
+	e.pods.Insert(types.NamespacedName{Namespace: namespace, Name: name}.String())
+}
+
+// Excludes returns true if `pod` must not be evicted.
+func (e *PodExclusions) Excludes(pod v1.Pod) bool {
+	if e == nil {
+		return false
+	}
+	if e.pods.Has(podKey(pod)) {
+		return true
+	}
+	for _, pattern := range e.namespaces {
+		if matched, _ := path.Match(pattern, pod.Namespace); matched {
+			return true
+		}
+	}
+	if e.selector != nil && e.selector.Matches(labels.Set(pod.Labels)) {
+		return true
+	}
+	return e.annotation != "" && pod.Annotations[e.annotation] == "true"
+}
+
+func (e *PodExclusions) String() string {
+	return fmt.Sprintf("pods: %v, namespaces: %v, selector: %v, annotation: %q", e.pods.List(), e.namespaces, e.selector, e.annotation)
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPodExclusions(t *testing.T) {
+	pods := []types.NamespacedName{{Name: "handler", Namespace: "kube-system"}, {Name: "handler", Namespace: "batch"}}
+	exclusions, err := NewPodExclusions(pods, []string{"monitoring-*"}, "app=fluentbit", "node-termination-handler/exclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Excluding a pod of the same name does not replace the exclusions of other namespaces.
+	exclusions.ExcludePod("handler", "node-termination-handler")
+	for _, test := range []struct {
+		desc        string
+		name        string
+		namespace   string
+		labels      map[string]string
+		annotations map[string]string
+		expected    bool
+	}{
+		{desc: "excluded by name", name: "handler", namespace: "kube-system", expected: true},
+		{desc: "same name in another excluded namespace", name: "handler", namespace: "batch", expected: true},
+		{desc: "same name excluded later", name: "handler", namespace: "node-termination-handler", expected: true},
+		{desc: "same name in another namespace", name: "handler", namespace: "default"},
+		{desc: "excluded by namespace", name: "prometheus-0", namespace: "monitoring-prod", expected: true},
+		{desc: "excluded by labels", name: "fluentbit-x7k2p", namespace: "logging", labels: map[string]string{"app": "fluentbit"}, expected: true},
+		{desc: "excluded by annotation", name: "web-5d8f9", namespace: "default", annotations: map[string]string{"node-termination-handler/exclude": "true"}, expected: true},
+		{desc: "annotation set to false", name: "web-5d8f9", namespace: "default", annotations: map[string]string{"node-termination-handler/exclude": "false"}},
+		{desc: "not excluded", name: "web-5d8f9", namespace: "default", labels: map[string]string{"app": "web"}},
+	} {
+		pod := makePod(pod{name: test.name, namespace: test.namespace, nodeName: "localhost"})
+		pod.Labels = test.labels
+		pod.Annotations = test.annotations
+		if actual := exclusions.Excludes(pod); actual != test.expected {
+			t.Errorf("%s: expected exclusion to be %v, got %v", test.desc, test.expected, actual)
+		}
+	}
+}
+
+func TestInvalidPodExclusions(t *testing.T) {
+	if _, err := NewPodExclusions(nil, []string{"monitoring-["}, "", ""); err == nil {
+		t.Error("expected invalid namespace pattern to be rejected")
+	}
+	if _, err := NewPodExclusions(nil, nil, "app in (web", ""); err == nil {
+		t.Error("expected invalid selector to be rejected")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+const (
+	instanceNameSuffix = "instance/name"
+	zoneSuffix         = "instance/zone"
+	projectIDSuffix    = "project/project-id"
+)
+
+// MetadataUpdate is a single step of the timeline replayed by FakeMetadataClient.
+type MetadataUpdate struct {
+	// Delay is the time to wait after the previous step before applying this one.
+	Delay time.Duration
+	// Suffix identifies the metadata entry to update, e.g. `instance/maintenance-event`.
+	Suffix string
+	// Value is the new value of the entry.
+	Value string
+	// Deleted removes the entry instead of updating it.
+	Deleted bool
+}
+
+// FakeMetadataClient is a MetadataClient that serves in-memory values and replays a scripted timeline of updates.
+// Zone, instance name and project ID are served from their usual metadata entries.
+type FakeMetadataClient struct {
+	sync.Mutex
+	changed  *sync.Cond
+	values   map[string]string
+	versions map[string]int
+	timeline []MetadataUpdate
+}
+
+// NewFakeMetadataClient returns a fake metadata server that initially serves `values` and then applies `timeline` as it gets replayed.
+func NewFakeMetadataClient(values map[string]string, timeline []MetadataUpdate) *FakeMetadataClient {
+	f := &FakeMetadataClient{
+		values:   map[string]string{},
+		versions: map[string]int{},
+		timeline: timeline,
+	}
+	f.changed = sync.NewCond(&f.Mutex)
+	for suffix, value := range values {
+		f.values[suffix] = value
+	}
+	return f
+}
+
+// Step applies the next update of the timeline immediately, ignoring its delay.
+// It returns false once the timeline has been exhausted.
+func (f *FakeMetadataClient) Step() bool {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.timeline) == 0 {
+		return false
+	}
+	f.apply(f.timeline[0])
+	f.timeline = f.timeline[1:]
+	return true
+}
+
+// Replay applies the remaining updates of the timeline honoring their delays. It blocks until the timeline has been exhausted.
+func (f *FakeMetadataClient) Replay() {
+	for {
+		f.Lock()
+		if len(f.timeline) == 0 {
+			f.Unlock()
+			return
+		}
+		delay := f.timeline[0].Delay
+		f.Unlock()
+		time.Sleep(delay)
+		f.Step()
+	}
+}
+
+func (f *FakeMetadataClient) apply(update MetadataUpdate) {
+	if update.Deleted {
+		delete(f.values, update.Suffix)
+	} else {
+		f.values[update.Suffix] = update.Value
+	}
+	f.versions[update.Suffix]++
+	f.changed.Broadcast()
+}
+
+func (f *FakeMetadataClient) Get(suffix string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	value, exists := f.values[suffix]
+	if !exists {
+		return "", metadata.NotDefinedError(suffix)
+	}
+	return value, nil
+}
+
+func (f *FakeMetadataClient) Subscribe(suffix string, fn func(v string, ok bool) error) error {
+	f.Lock()
+	value, exists := f.values[suffix]
+	version := f.versions[suffix]
+	f.Unlock()
+	if !exists {
+		return metadata.NotDefinedError(suffix)
+	}
+	if err := fn(value, true); err != nil {
+		return err
+	}
+	for {
+		f.Lock()
+		for f.versions[suffix] == version {
+			f.changed.Wait()
+		}
+		value, exists = f.values[suffix]
+		version = f.versions[suffix]
+		f.Unlock()
+		if err := fn(value, exists); err != nil || !exists {
+			return err
+		}
+	}
+}
+
+func (f *FakeMetadataClient) InstanceName() (string, error) {
+	return f.Get(instanceNameSuffix)
+}
+
+func (f *FakeMetadataClient) Zone() (string, error) {
+	zone, err := f.Get(zoneSuffix)
+	if err != nil {
+		return "", err
+	}
+	// Zones are served as `projects/<project-number>/zones/<zone>`.
+	return zone[strings.LastIndex(zone, "/")+1:], nil
+}
+
+func (f *FakeMetadataClient) ProjectID() (string, error) {
+	return f.Get(projectIDSuffix)
+}
@@ -15,12 +15,16 @@
 package termination
 
 import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
 	"sync"
 	"time"
 
+	"cloud.google.com/go/compute/metadata"
 	"github.com/golang/glog"
 
-	"cloud.google.com/go/compute/metadata"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
@@ -28,103 +32,282 @@ const (
 	onHostMaintenanceSuffix            = "instance/scheduling/on-host-maintenance"
 	terminateForMaintenance            = "TERMINATE"
 	isPreemptibleSuffix                = "instance/scheduling/preemptible"
+	provisioningModelSuffix            = "instance/scheduling/provisioning-model"
+	provisioningModelSpot              = "SPOT"
+	terminationActionSuffix            = "instance/scheduling/instance-termination-action"
+	terminationActionStop              = "STOP"
+	terminationTimeSuffix              = "instance/scheduling/termination-time"
 	maintenanceEventTerminate          = "TERMINATE_ON_HOST_MAINTENANCE"
+	maintenanceEventMigrate            = "MIGRATE_ON_HOST_MAINTENANCE"
 	maintenanceEventTrue               = "TRUE"
 	maintenanceEventSuffix             = "instance/maintenance-event"
 	preemptedEventSuffix               = "instance/preempted"
 	preemptibleNodeTerminationDuration = 30 * time.Second
+	upcomingMaintenanceSuffix          = "instance/upcoming-maintenance"
+	upcomingMaintenancePollInterval    = time.Minute
+	scheduledTerminationPollInterval   = time.Minute
+	gceObservationKey                  = "gce"
 )
 
+// gceUpcomingMaintenance is the document served at `instance/upcoming-maintenance`.
+type gceUpcomingMaintenance struct {
+	Type            string          `json:"type"`
+	Status          string          `json:"maintenance_status"`
+	WindowStartTime time.Time       `json:"window_start_time"`
+	WindowEndTime   time.Time       `json:"window_end_time"`
+	CanReschedule   json.RawMessage `json:"can_reschedule"`
+}
+
 type gceTerminationSource struct {
 	sync.RWMutex
+	client                         MetadataClient
 	needsTerminationHandling       bool
 	state                          NodeTerminationState
 	updateChannel                  chan NodeTerminationState
 	regularNodeTerminationDuration time.Duration
+	observations                   *ObservationStore
+	preemptible                    bool
+	// maintenanceEvent and preempted hold the latest values of the corresponding metadata entries.
+	maintenanceEvent string
+	preempted        string
+	// scheduledTermination is the time at which VMs created with a `max-run-duration` or `termination-time` are shut down.
+	// It is zero for other VMs. A termination is reported `scheduledTerminationLeadTime` ahead of it.
+	scheduledTermination         time.Time
+	scheduledTerminationLeadTime time.Duration
+	// scheduledTerminationTimer reports the scheduled termination once its lead time has been reached.
+	scheduledTerminationTimer *time.Timer
 }
 
-func NewGCETerminationSource(regularNodeTimeout time.Duration) (NodeTerminationSource, error) {
+func NewGCETerminationSource(client MetadataClient, regularNodeTimeout, scheduledTerminationLeadTime time.Duration, observations *ObservationStore) (NodeTerminationSource, error) {
 	ret := &gceTerminationSource{
+		client:                         client,
 		updateChannel:                  make(chan NodeTerminationState),
 		regularNodeTerminationDuration: regularNodeTimeout,
+		scheduledTerminationLeadTime:   scheduledTerminationLeadTime,
+		observations:                   observations,
 	}
 	var err error
 	// Nothing to do for nodes that will not be disrupted by terminations.
-	ret.needsTerminationHandling, err = needsTerminationHandling()
+	ret.needsTerminationHandling, err = ret.isTerminatedOnMaintenance()
 	if err != nil {
 		return nil, err
 	}
 	// Get the Instance name
-	ret.state.NodeName, err = metadata.InstanceName()
+	ret.state.NodeName, err = client.InstanceName()
 	if err != nil {
 		return nil, err
 	}
-	ret.state.NeedsReboot, err = needsReboot()
+	ret.preemptible, err = ret.isPreemptible()
 	if err != nil {
 		return nil, err
 	}
-	// Check if a termination is already pending. This can happen if the termination watcher restarts.
-	pendingTermination, err := pendingTermination()
+	ret.state.NeedsReboot = !ret.preemptible
+	terminationAction, err := ret.getOptional(terminationActionSuffix)
 	if err != nil {
 		return nil, err
 	}
-	// Store a pending termination.
-	if pendingTermination {
-		ret.storePendingTermination()
+	ret.state.WillBeStopped = terminationAction == terminationActionStop
+	ret.state.UpcomingMaintenance, err = ret.upcomingMaintenance()
+	if err != nil {
+		return nil, err
+	}
+	ret.scheduledTermination, err = ret.getScheduledTermination()
+	if err != nil {
+		return nil, err
 	}
+	// Check if a termination is already pending. This can happen if the termination watcher restarts.
+	if ret.maintenanceEvent, err = client.Get(maintenanceEventSuffix); err != nil {
+		return nil, err
+	}
+	if ret.preempted, err = client.Get(preemptedEventSuffix); err != nil {
+		return nil, err
+	}
+	glog.V(4).Infof("Current states: Regular: %q, PVM: %q, Scheduled termination: %v", ret.maintenanceEvent, ret.preempted, ret.scheduledTermination)
+	ret.updateState()
 	return ret, nil
 }
 
-func pendingTermination() (bool, error) {
-	state, err := metadata.Get(maintenanceEventSuffix)
+// upcomingMaintenance returns the announced maintenance window, if any.
+func (g *gceTerminationSource) upcomingMaintenance() (*MaintenanceWindow, error) {
+	value, err := g.getOptional(upcomingMaintenanceSuffix)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	var maintenance gceUpcomingMaintenance
+	if err := json.Unmarshal([]byte(value), &maintenance); err != nil {
+		return nil, fmt.Errorf("failed to parse upcoming maintenance %q: %v", value, err)
+	}
+	glog.V(4).Infof("Upcoming maintenance: %+v", maintenance)
+	return &MaintenanceWindow{
+		Start:         maintenance.WindowStartTime,
+		End:           maintenance.WindowEndTime,
+		CanReschedule: strings.Trim(string(maintenance.CanReschedule), `"`) == "true",
+	}, nil
+}
+
+// pollUpcomingMaintenance publishes changes to the announced maintenance window.
+func (g *gceTerminationSource) pollUpcomingMaintenance() {
+	window, err := g.upcomingMaintenance()
 	if err != nil {
-		return false, err
+		glog.Errorf("Failed to get upcoming maintenance for node %q - %v", g.state.NodeName, err)
+		return
 	}
-	pvmState, err := metadata.Get(preemptedEventSuffix)
+	g.Lock()
+	if reflect.DeepEqual(window, g.state.UpcomingMaintenance) {
+		g.Unlock()
+		return
+	}
+	glog.Infof("Upcoming maintenance changed to %+v", window)
+	g.state.UpcomingMaintenance = window
+	g.Unlock()
+	g.updateChannel <- g.GetState()
+}
+
+// getScheduledTermination returns the time at which the VM is scheduled to be shut down, or zero if it is not.
+func (g *gceTerminationSource) getScheduledTermination() (time.Time, error) {
+	value, err := g.getOptional(terminationTimeSuffix)
+	if err != nil || value == "" {
+		return time.Time{}, err
+	}
+	terminationTime, err := time.Parse(time.RFC3339, value)
 	if err != nil {
-		return false, err
+		return time.Time{}, fmt.Errorf("failed to parse scheduled termination time %q: %v", value, err)
+	}
+	return terminationTime, nil
+}
+
+// pollScheduledTermination publishes changes to the scheduled termination time.
+func (g *gceTerminationSource) pollScheduledTermination() {
+	terminationTime, err := g.getScheduledTermination()
+	if err != nil {
+		glog.Errorf("Failed to get scheduled termination time for node %q - %v", g.state.NodeName, err)
+		return
+	}
+	g.Lock()
+	if terminationTime.Equal(g.scheduledTermination) {
+		g.Unlock()
+		return
 	}
-	glog.V(4).Infof("Current states: Regular: %q, PVM: %q", state, pvmState)
-	return (state == maintenanceEventTerminate || pvmState == maintenanceEventTrue), nil
+	glog.Infof("Scheduled termination time changed to %v", terminationTime)
+	g.scheduledTermination = terminationTime
+	g.Unlock()
+	g.updateChannel <- g.updateState()
 }
 
-func needsTerminationHandling() (bool, error) {
-	maintenanceMode, err := metadata.Get(onHostMaintenanceSuffix)
+func (g *gceTerminationSource) isTerminatedOnMaintenance() (bool, error) {
+	maintenanceMode, err := g.client.Get(onHostMaintenanceSuffix)
 	if err != nil || maintenanceMode != terminateForMaintenance {
 		return false, err
 	}
 	return true, nil
 }
 
-func needsReboot() (bool, error) {
-	isPreemptible, err := metadata.Get(isPreemptibleSuffix)
+func (g *gceTerminationSource) isPreemptible() (bool, error) {
+	isPreemptible, err := g.client.Get(isPreemptibleSuffix)
 	if err != nil {
 		return false, err
 	}
-	// If a node is Preemptible there is no point in restarting it since it will be deleted anyways.
-	return isPreemptible != maintenanceEventTrue, nil
+	// Spot VMs are not flagged as preemptible but are preempted all the same.
+	provisioningModel, err := g.getOptional(provisioningModelSuffix)
+	if err != nil {
+		return false, err
+	}
+	return isPreemptible == maintenanceEventTrue || provisioningModel == provisioningModelSpot, nil
+}
+
+// getOptional returns the value of a metadata entry that is not defined for all VMs, or an empty string if it is not defined.
+func (g *gceTerminationSource) getOptional(suffix string) (string, error) {
+	value, err := g.client.Get(suffix)
+	if _, notDefined := err.(metadata.NotDefinedError); notDefined {
+		return "", nil
+	}
+	return value, err
 }
 
-func (g *gceTerminationSource) storePendingTermination() {
+// updateState recomputes the state from the latest values of the maintenance metadata entries and returns it.
+func (g *gceTerminationSource) updateState() NodeTerminationState {
 	g.Lock()
 	defer g.Unlock()
 
+	// Live migratable VMs are expected to observe `MIGRATE_ON_HOST_MAINTENANCE` while being moved to another host.
+	g.state.LiveMigration = g.maintenanceEvent == maintenanceEventMigrate
+	// Regular GPU VMs are expected to observe `TERMINATE_ON_HOST_MAINTENANCE` on `maintenance-event` metadata variable.
+	// PVMs are expected to observe `TRUE` on `preempted` metadata variable.
+	maintenance := (!g.preemptible && g.maintenanceEvent == maintenanceEventTerminate) || // Regular VM
+		(g.preemptible && g.preempted == maintenanceEventTrue) // PVM
+	scheduled := g.scheduledTerminationDue()
+	// There is no point in restarting a Preemptible node or a node that reached its scheduled termination since it
+	// will be shut down anyways.
+	g.state.NeedsReboot = !g.preemptible && !scheduled
+	pendingTermination := maintenance || scheduled
+	switch {
+	case pendingTermination:
+		if !g.state.PendingTermination {
+			glog.Infof("Recording impending termination")
+		}
+		g.storePendingTermination(maintenance, scheduled)
+	case !pendingTermination && g.state.PendingTermination:
+		glog.Infof("Removing any impending termination records")
+		g.resetPendingTermination()
+	case !pendingTermination:
+		// Drop observations left behind by a previous run of the handler.
+		g.observations.Forget(gceObservationKey)
+	}
+	return g.state
+}
+
+// scheduledTerminationDue returns true once the lead time of the scheduled termination has been reached.
+// Otherwise it arms a timer to report the scheduled termination in time. It must be invoked with the lock held.
+func (g *gceTerminationSource) scheduledTerminationDue() bool {
+	if g.scheduledTerminationTimer != nil {
+		g.scheduledTerminationTimer.Stop()
+		g.scheduledTerminationTimer = nil
+	}
+	if g.scheduledTermination.IsZero() {
+		return false
+	}
+	wait := g.scheduledTermination.Add(-g.scheduledTerminationLeadTime).Sub(time.Now())
+	if wait <= 0 {
+		return true
+	}
+	g.scheduledTerminationTimer = time.AfterFunc(wait, func() {
+		g.updateChannel <- g.updateState()
+	})
+	return false
+}
+
+// storePendingTermination records a termination caused by host maintenance or preemption and/or by the scheduled
+// termination of the VM. It must be invoked with the lock held.
+func (g *gceTerminationSource) storePendingTermination(maintenance, scheduled bool) {
 	g.state.PendingTermination = true
-	terminationTime := time.Now()
-	if !g.state.NeedsReboot {
-		// This is a Preemptible node
-		g.state.TerminationTime = terminationTime.Add(preemptibleNodeTerminationDuration)
-	} else {
-		g.state.TerminationTime = terminationTime.Add(g.regularNodeTerminationDuration)
+	// Anchor the deadline to the time the termination was first observed, which can predate a restart of the handler.
+	observedTime := g.observations.Observe(gceObservationKey, time.Now())
+	g.state.ObservedTime = observedTime
+	var terminationTime time.Time
+	if scheduled {
+		terminationTime = g.scheduledTermination
+	}
+	if maintenance {
+		deadline := observedTime.Add(g.regularNodeTerminationDuration)
+		if g.preemptible {
+			deadline = observedTime.Add(preemptibleNodeTerminationDuration)
+		} else if window := g.state.UpcomingMaintenance; window != nil && window.Start.After(observedTime) && window.Start.Before(deadline) {
+			// Maintenance can start before the regular timeout if an earlier window has been announced.
+			deadline = window.Start
+		}
+		if terminationTime.IsZero() || deadline.Before(terminationTime) {
+			terminationTime = deadline
+		}
 	}
+	g.state.TerminationTime = terminationTime
 }
 
+// resetPendingTermination must be invoked with the lock held.
 func (g *gceTerminationSource) resetPendingTermination() {
-	g.Lock()
-	defer g.Unlock()
-
 	g.state.PendingTermination = false
+	g.state.ObservedTime = time.Time{}
 	g.state.TerminationTime = time.Now()
+	g.observations.Forget(gceObservationKey)
 }
 
 func (g *gceTerminationSource) handleMaintenanceEvents(state string, exists bool) error {
@@ -133,40 +316,49 @@ func (g *gceTerminationSource) handleMaintenanceEvents(state string, exists bool
 		return nil
 	}
 	glog.Infof("Handling maintenance event with state: %q", state)
+	g.Lock()
+	g.maintenanceEvent = state
+	g.Unlock()
+	g.updateChannel <- g.updateState()
+	return nil
+}
 
-	// Regular GPU VMs are expected to observe `TERMINATE_ON_HOST_MAINTENANCE` on `maintenance-event` metadata variable.
-	// PVMs are expected to observe `TRUE` on `preempted` metadata variable.
-	if (g.state.NeedsReboot && state == maintenanceEventTerminate) || // Regular VM
-		(!g.state.NeedsReboot && state == maintenanceEventTrue) { // PVM
-		glog.Infof("Recording impending termination")
-		g.storePendingTermination()
-		g.updateChannel <- g.state
-	} else {
-		glog.Infof("Removing any impending termination records")
-		g.resetPendingTermination()
-		g.updateChannel <- g.state
+func (g *gceTerminationSource) handlePreemptionEvents(state string, exists bool) error {
+	if !exists {
+		glog.Errorf("Preemption Event Metadata API deleted unexpectedly")
+		return nil
 	}
+	glog.Infof("Handling preemption event with state: %q", state)
+	g.Lock()
+	g.preempted = state
+	g.Unlock()
+	g.updateChannel <- g.updateState()
 	return nil
 }
 
 func (g *gceTerminationSource) WatchState() <-chan NodeTerminationState {
-	if !g.needsTerminationHandling {
-		return nil
-	}
+	// Live migratable VMs are watched for live migrations only.
 	go wait.Forever(func() {
-		err := metadata.Subscribe(maintenanceEventSuffix, g.handleMaintenanceEvents)
+		err := g.client.Subscribe(maintenanceEventSuffix, g.handleMaintenanceEvents)
 		if err != nil {
 			glog.Errorf("Failed to get maintenance status for node %q - %v", g.state.NodeName, err)
 			return
 		}
 	}, time.Second)
+	// Any VM can be created with a scheduled termination time.
+	go wait.Forever(g.pollScheduledTermination, scheduledTerminationPollInterval)
+	if !g.needsTerminationHandling {
+		return g.updateChannel
+	}
 	go wait.Forever(func() {
-		err := metadata.Subscribe(preemptedEventSuffix, g.handleMaintenanceEvents)
+		err := g.client.Subscribe(preemptedEventSuffix, g.handlePreemptionEvents)
 		if err != nil {
 			glog.Errorf("Failed to get preemptible maintenance status for node %q - %v", g.state.NodeName, err)
 			return
 		}
 	}, time.Second)
+	// Upcoming maintenance is announced hours ahead of time and only needs to be polled occasionally.
+	go wait.Forever(g.pollUpcomingMaintenance, upcomingMaintenancePollInterval)
 	return g.updateChannel
 }
 
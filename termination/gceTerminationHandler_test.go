@@ -0,0 +1,285 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func gceMetadata(preemptible string) map[string]string {
+	return map[string]string{
+		instanceNameSuffix:      "gke-node",
+		onHostMaintenanceSuffix: terminateForMaintenance,
+		isPreemptibleSuffix:     preemptible,
+		maintenanceEventSuffix:  "NONE",
+		preemptedEventSuffix:    "FALSE",
+	}
+}
+
+// inMemoryObservations returns an observation store that is not persisted.
+func inMemoryObservations() *ObservationStore {
+	return &ObservationStore{observations: map[string]time.Time{}}
+}
+
+// nextState returns the next state published on `states` that differs from `previous`.
+func nextState(t *testing.T, states <-chan NodeTerminationState, previous NodeTerminationState) NodeTerminationState {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case state := <-states:
+			if state.PendingTermination != previous.PendingTermination {
+				return state
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a state update from %+v", previous)
+		}
+	}
+}
+
+func TestGCETerminationSource(t *testing.T) {
+	for _, test := range []struct {
+		desc                 string
+		preemptible          string
+		extraValues          map[string]string
+		timeline             []MetadataUpdate
+		expectedReboot       bool
+		expectedStop         bool
+		expectedDuration     time.Duration
+		expectedCancellation bool
+	}{
+		{
+			desc:        "preemption",
+			preemptible: "TRUE",
+			timeline: []MetadataUpdate{
+				{Delay: 100 * time.Millisecond, Suffix: maintenanceEventSuffix, Value: "NONE"},
+				{Suffix: preemptedEventSuffix, Value: "TRUE"},
+			},
+			expectedDuration: preemptibleNodeTerminationDuration,
+		},
+		{
+			desc:        "spot VM preemption",
+			preemptible: "FALSE",
+			extraValues: map[string]string{
+				provisioningModelSuffix: provisioningModelSpot,
+				terminationActionSuffix: terminationActionStop,
+			},
+			timeline: []MetadataUpdate{
+				{Delay: 100 * time.Millisecond, Suffix: preemptedEventSuffix, Value: "TRUE"},
+			},
+			expectedStop:     true,
+			expectedDuration: preemptibleNodeTerminationDuration,
+		},
+		{
+			desc:        "host maintenance",
+			preemptible: "FALSE",
+			timeline: []MetadataUpdate{
+				{Delay: 100 * time.Millisecond, Suffix: maintenanceEventSuffix, Value: maintenanceEventTerminate},
+			},
+			expectedReboot:   true,
+			expectedDuration: time.Hour,
+		},
+		{
+			desc:        "cancelled host maintenance",
+			preemptible: "FALSE",
+			timeline: []MetadataUpdate{
+				{Delay: 100 * time.Millisecond, Suffix: maintenanceEventSuffix, Value: maintenanceEventTerminate},
+				{Delay: 100 * time.Millisecond, Suffix: maintenanceEventSuffix, Value: "NONE"},
+			},
+			expectedReboot:       true,
+			expectedDuration:     time.Hour,
+			expectedCancellation: true,
+		},
+	} {
+		values := gceMetadata(test.preemptible)
+		for suffix, value := range test.extraValues {
+			values[suffix] = value
+		}
+		client := NewFakeMetadataClient(values, test.timeline)
+		source, err := NewGCETerminationSource(client, time.Hour, 0, inMemoryObservations())
+		if err != nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+		state := source.GetState()
+		if state.NodeName != "gke-node" || state.PendingTermination || state.NeedsReboot != test.expectedReboot || state.WillBeStopped != test.expectedStop {
+			t.Fatalf("%s: unexpected initial state %+v", test.desc, state)
+		}
+		states := source.WatchState()
+		// Timelines start with a delay so that both subscriptions publish their initial values first.
+		go client.Replay()
+
+		start := time.Now()
+		state = nextState(t, states, state)
+		if !state.PendingTermination {
+			t.Fatalf("%s: expected a pending termination, got %+v", test.desc, state)
+		}
+		if deadline := state.TerminationTime.Sub(start); deadline < test.expectedDuration-time.Second || deadline > test.expectedDuration+time.Second {
+			t.Errorf("%s: expected termination in %v, got %v", test.desc, test.expectedDuration, deadline)
+		}
+		if test.expectedCancellation {
+			if state = nextState(t, states, state); state.PendingTermination {
+				t.Fatalf("%s: expected the termination to be cancelled, got %+v", test.desc, state)
+			}
+		}
+	}
+}
+
+func TestGCEUpcomingMaintenance(t *testing.T) {
+	values := gceMetadata("FALSE")
+	values[upcomingMaintenanceSuffix] = `{"can_reschedule": "true", "maintenance_status": "PENDING", "type": "SCHEDULED", "window_start_time": "2018-06-01T10:00:00Z", "window_end_time": "2018-06-01T14:00:00Z"}`
+	client := NewFakeMetadataClient(values, []MetadataUpdate{{Suffix: upcomingMaintenanceSuffix, Deleted: true}})
+	source, err := NewGCETerminationSource(client, time.Hour, 0, inMemoryObservations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := source.GetState()
+	expected := MaintenanceWindow{
+		Start:         time.Date(2018, time.June, 1, 10, 0, 0, 0, time.UTC),
+		End:           time.Date(2018, time.June, 1, 14, 0, 0, 0, time.UTC),
+		CanReschedule: true,
+	}
+	if state.PendingTermination || state.UpcomingMaintenance == nil || *state.UpcomingMaintenance != expected {
+		t.Fatalf("expected upcoming maintenance %+v without a pending termination, got %+v", expected, state)
+	}
+
+	client.Step()
+	gceSource := source.(*gceTerminationSource)
+	go gceSource.pollUpcomingMaintenance()
+	select {
+	case state := <-gceSource.updateChannel:
+		if state.UpcomingMaintenance != nil {
+			t.Fatalf("expected upcoming maintenance to be cleared, got %+v", state.UpcomingMaintenance)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a state update")
+	}
+}
+
+func TestGCELiveMigration(t *testing.T) {
+	values := gceMetadata("FALSE")
+	values[onHostMaintenanceSuffix] = "MIGRATE"
+	client := NewFakeMetadataClient(values, []MetadataUpdate{
+		{Delay: 100 * time.Millisecond, Suffix: maintenanceEventSuffix, Value: maintenanceEventMigrate},
+		{Delay: 100 * time.Millisecond, Suffix: maintenanceEventSuffix, Value: "NONE"},
+	})
+	source, err := NewGCETerminationSource(client, time.Hour, 0, inMemoryObservations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := source.WatchState()
+	if states == nil {
+		t.Fatal("expected live migratable VMs to be watched")
+	}
+	go client.Replay()
+
+	timeout := time.After(5 * time.Second)
+	for _, expectedMigration := range []bool{true, false} {
+		for received := false; !received; {
+			select {
+			case state := <-states:
+				if state.PendingTermination {
+					t.Fatalf("expected no pending termination during live migration, got %+v", state)
+				}
+				received = state.LiveMigration == expectedMigration
+			case <-timeout:
+				t.Fatalf("timed out waiting for live migration to be %v", expectedMigration)
+			}
+		}
+	}
+}
+
+func TestGCETerminationSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "observations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "observations.json")
+	values := gceMetadata("FALSE")
+	values[maintenanceEventSuffix] = maintenanceEventTerminate
+
+	observed := time.Now().Add(-10 * time.Minute).Round(time.Second)
+	observations, err := NewObservationStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	observations.Observe(gceObservationKey, observed)
+	// A new store simulates a restart of the handler.
+	if observations, err = NewObservationStore(path); err != nil {
+		t.Fatal(err)
+	}
+	source, err := NewGCETerminationSource(NewFakeMetadataClient(values, nil), time.Hour, 0, observations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := source.GetState()
+	if !state.PendingTermination || !state.ObservedTime.Equal(observed) || !state.TerminationTime.Equal(observed.Add(time.Hour)) {
+		t.Fatalf("expected a termination observed at %v and due at %v, got %+v", observed, observed.Add(time.Hour), state)
+	}
+
+	// Observations are dropped once the termination is no longer pending.
+	values[maintenanceEventSuffix] = "NONE"
+	if _, err = NewGCETerminationSource(NewFakeMetadataClient(values, nil), time.Hour, 0, observations); err != nil {
+		t.Fatal(err)
+	}
+	if observations, err = NewObservationStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if now := time.Now(); !observations.Observe(gceObservationKey, now).Equal(now) {
+		t.Fatal("expected the observation to be forgotten")
+	}
+}
+
+func TestGCEScheduledTermination(t *testing.T) {
+	for _, test := range []struct {
+		desc            string
+		remaining       time.Duration
+		leadTime        time.Duration
+		expectedPending bool
+	}{
+		{
+			desc:            "lead time already reached",
+			remaining:       5 * time.Minute,
+			leadTime:        10 * time.Minute,
+			expectedPending: true,
+		},
+		{
+			desc:      "lead time reached later",
+			remaining: 10*time.Minute + time.Second,
+			leadTime:  10 * time.Minute,
+		},
+	} {
+		scheduled := time.Now().Add(test.remaining).Round(time.Second)
+		values := gceMetadata("FALSE")
+		values[terminationTimeSuffix] = scheduled.Format(time.RFC3339)
+		source, err := NewGCETerminationSource(NewFakeMetadataClient(values, nil), time.Hour, test.leadTime, inMemoryObservations())
+		if err != nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+		state := source.GetState()
+		if state.PendingTermination != test.expectedPending {
+			t.Fatalf("%s: expected pending termination to be %v, got %+v", test.desc, test.expectedPending, state)
+		}
+		if !state.PendingTermination {
+			state = nextState(t, source.(*gceTerminationSource).updateChannel, state)
+		}
+		if !state.TerminationTime.Equal(scheduled) || state.NeedsReboot {
+			t.Errorf("%s: expected a termination at %v without reboot, got %+v", test.desc, scheduled, state)
+		}
+	}
+}
@@ -15,43 +15,97 @@
 package termination
 
 import (
+	"fmt"
 	"reflect"
+	"sync"
 	"syscall"
 	"time"
 
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/wait"
 
 	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 )
 
+// liveMigrationFailedReason is recorded on the node when the start or end of a live migration could not be handled.
+const liveMigrationFailedReason = "NodeLiveMigrationFailed"
+
 type nodeTerminationHandler struct {
 	currentNodeState   NodeTerminationState
 	taintHandler       NodeTaintHandler
 	podEvictionHandler PodEvictionHandler
 	terminationSource  NodeTerminationSource
-	excludePods        map[string]string
+	exclusions         *PodExclusions
+	// notifier is optional.
+	notifier Notifier
+	// liveMigrationHook is optional.
+	liveMigrationHook LiveMigrationHook
+	// liveMigrationMarked and liveMigrationHooked record whether the node was last marked, and the hook last run, for
+	// a live migration in progress. They are tracked separately such that failures are retried without repeating
+	// what succeeded. liveMigrationMarked is nil until the node is first marked, such that an annotation left behind
+	// by a previous run is removed.
+	liveMigrationMarked *bool
+	liveMigrationHooked bool
+	rebooter            NodeRebooter
+	node                string
+	recorder            record.EventRecorder
+	// announcedWindow is the upcoming maintenance that was last announced. It is nil unless maintenance is upcoming.
+	announcedWindow *MaintenanceWindow
+	// drained is set once pods have been evicted for the current node state, such that they are neither evicted nor
+	// reported again while the following steps are retried.
+	drained bool
+	// stopEvictions is open while a termination is pending and closed as soon as it is cancelled.
+	// It is nil while no termination is pending.
+	lock          sync.Mutex
+	stopEvictions chan struct{}
 }
 
 func NewNodeTerminationHandler(
 	source NodeTerminationSource,
 	taintHandler NodeTaintHandler,
 	evictionHandler PodEvictionHandler,
-	excludePods map[string]string) NodeTerminationHandler {
+	exclusions *PodExclusions,
+	notifier Notifier,
+	liveMigrationHook LiveMigrationHook,
+	rebooter NodeRebooter,
+	node string,
+	recorder record.EventRecorder) NodeTerminationHandler {
 	return &nodeTerminationHandler{
 		taintHandler:       taintHandler,
 		podEvictionHandler: evictionHandler,
 		terminationSource:  source,
-		excludePods:        excludePods,
+		exclusions:         exclusions,
+		notifier:           notifier,
+		liveMigrationHook:  liveMigrationHook,
+		rebooter:           rebooter,
+		node:               node,
+		recorder:           recorder,
 	}
 }
 
 func (n *nodeTerminationHandler) processNodeState() error {
+	// Live migrations are best effort. Failures are retried with the following states, and never hold back terminations.
+	if err := n.processLiveMigration(n.currentNodeState.LiveMigration); err != nil {
+		glog.Errorf("Failed to handle live migration: %v", err)
+		ref := &v1.ObjectReference{Kind: "Node", Name: n.node, UID: types.UID(n.node)}
+		n.recorder.Eventf(ref, v1.EventTypeWarning, liveMigrationFailedReason, "Failed to handle live migration: %v", err)
+	}
 	// Handle regular node state.
 	if !n.currentNodeState.PendingTermination {
+		if window := n.currentNodeState.UpcomingMaintenance; window != nil {
+			return n.processUpcomingMaintenance(*window)
+		}
+		n.announcedWindow = nil
 		glog.V(4).Infof("No pending terminations. Removing taint")
 		return n.taintHandler.RemoveTaint()
 	}
 	glog.V(4).Infof("Current node state: %v", n.currentNodeState)
+	// The maintenance is announced again should the termination be cancelled while it is still upcoming.
+	n.announcedWindow = nil
 	// Handle a node that is about to be terminated.
 	// Log an event that a termination is impending.
 	// Reserve some time for restarting the node.
@@ -61,41 +115,193 @@ func (n *nodeTerminationHandler) processNodeState() error {
 	if timeout.Seconds() >= 120 {
 		timeout = timeout - time.Minute
 	}
+	deadline := time.Now().Add(timeout)
 	glog.V(4).Infof("Applying taint prior to handling termination")
-	if err := sendSlack(); err != nil {
-		glog.Errorf("Failed to send slack: %v", err)
-	}
+	n.notify(terminationTitle)
 	if err := n.taintHandler.ApplyTaint(); err != nil {
 		return err
 	}
-	glog.V(4).Infof("Evicting all pods from the node")
-	if err := n.podEvictionHandler.EvictPods(n.excludePods, timeout); err != nil {
-		return err
+	stopCh := n.evictionStopCh()
+	if stopCh == nil || isStopped(stopCh) {
+		glog.V(4).Infof("Pending termination was cancelled. Not evicting pods")
+		return nil
+	}
+	if n.drained {
+		glog.V(4).Infof("Pods have already been evicted for the pending termination")
+	} else {
+		glog.V(4).Infof("Evicting all pods from the node")
+		if err := n.podEvictionHandler.EvictPods(n.exclusions, timeout, stopCh); err != nil {
+			return err
+		}
+		if isStopped(stopCh) {
+			glog.V(4).Infof("Pending termination was cancelled while evicting pods")
+			return nil
+		}
+		n.drained = true
+	}
+	if acknowledger, ok := n.terminationSource.(NodeTerminationAcknowledger); ok {
+		glog.V(4).Infof("Acknowledging termination")
+		if err := acknowledger.AcknowledgeTermination(n.currentNodeState); err != nil {
+			return err
+		}
+	}
+	if n.currentNodeState.WillBeStopped {
+		// The taint is removed once the VM is started again and no termination is pending anymore.
+		glog.V(4).Infof("The VM will be stopped rather than deleted. Expecting the node to come back")
 	}
 	if n.currentNodeState.NeedsReboot {
+		if waiter, ok := n.podEvictionHandler.(VolumeDetachWaiter); ok {
+			// Volumes left attached delay the pods replacing the evicted ones until they are forcefully detached.
+			glog.V(4).Infof("Waiting for volumes to be detached prior to rebooting")
+			if _, err := waiter.WaitForVolumeDetach(deadline); err != nil {
+				glog.Errorf("Failed to wait for volumes to be detached: %v", err)
+			}
+		}
 		glog.V(4).Infof("Rebooting the node")
-		return n.rebootNode()
+		return n.rebooter.Reboot()
+	}
+	glog.V(4).Infof("The pending termination does not need a reboot")
+	return nil
+}
+
+// processUpcomingMaintenance notifies about maintenance announced ahead of time and discourages new pods from
+// being scheduled on the node. Pods are only evicted once the maintenance actually happens.
+// Every window is announced once, regardless of unrelated changes of the node state.
+func (n *nodeTerminationHandler) processUpcomingMaintenance(window MaintenanceWindow) error {
+	if announced := n.announcedWindow; announced != nil && announced.Start.Equal(window.Start) && announced.End.Equal(window.End) {
+		glog.V(4).Infof("Maintenance scheduled between %v and %v has already been announced", window.Start, window.End)
+		return nil
 	}
+	glog.V(4).Infof("Maintenance scheduled between %v and %v", window.Start, window.End)
+	if err := n.taintHandler.ApplyAdvanceNoticeTaint(window); err != nil {
+		return err
+	}
+	n.announcedWindow = &window
+	n.notify(upcomingMaintenanceTitle)
 	return nil
 }
 
-func (n *nodeTerminationHandler) rebootNode() error {
+// notify sends a notification titled `title`, if a notifier is configured. Failures are only logged.
+func (n *nodeTerminationHandler) notify(title string) {
+	if n.notifier == nil {
+		return
+	}
+	if err := n.notifier.Notify(title); err != nil {
+		glog.Errorf("Failed to send notification: %v", err)
+	}
+}
+
+// processLiveMigration records the start and end of live migrations and runs the live migration hook, if any.
+// Pods are never evicted for live migrations. Marking the node and running the hook are retried independently.
+func (n *nodeTerminationHandler) processLiveMigration(inProgress bool) error {
+	var errs []error
+	if n.liveMigrationMarked == nil || inProgress != *n.liveMigrationMarked {
+		glog.V(4).Infof("Live migration in progress: %v", inProgress)
+		if err := n.taintHandler.MarkLiveMigration(inProgress); err != nil {
+			errs = append(errs, fmt.Errorf("failed to mark live migration: %v", err))
+		} else {
+			n.liveMigrationMarked = &inProgress
+		}
+	}
+	if n.liveMigrationHook != nil && inProgress != n.liveMigrationHooked {
+		var err error
+		if inProgress {
+			err = n.liveMigrationHook.MigrationStarted()
+		} else {
+			err = n.liveMigrationHook.MigrationCompleted()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("live migration hook failed: %v", err))
+		} else {
+			n.liveMigrationHooked = inProgress
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+type nodeRebooter struct{}
+
+// NewNodeRebooter returns a NodeRebooter that syncs the filesystem and restarts the node.
+func NewNodeRebooter() NodeRebooter {
+	return nodeRebooter{}
+}
+
+func (nodeRebooter) Reboot() error {
 	// Sync the filesystem.
 	syscall.Sync()
 	// Reboot the node.
 	return syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART2)
 }
 
+// trackCancellation makes evictions stoppable while `state` has a pending termination, and stops them once it does not.
+func (n *nodeTerminationHandler) trackCancellation(state NodeTerminationState) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if state.PendingTermination {
+		if n.stopEvictions == nil {
+			n.stopEvictions = make(chan struct{})
+		}
+		return
+	}
+	if n.stopEvictions != nil {
+		close(n.stopEvictions)
+		n.stopEvictions = nil
+	}
+}
+
+// evictionStopCh returns the channel closed once the pending termination is cancelled, or nil if it already was.
+func (n *nodeTerminationHandler) evictionStopCh() <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.stopEvictions
+}
+
+// watchState forwards the latest state published by the termination source. States are consumed as soon as they are
+// published, even while evicting pods, so that evictions are stopped as soon as the pending termination is cancelled.
+// Intermediate states are dropped while the previous state is being processed.
+func (n *nodeTerminationHandler) watchState() <-chan NodeTerminationState {
+	states := n.terminationSource.WatchState()
+	out := make(chan NodeTerminationState)
+	go func() {
+		defer close(out)
+		var (
+			latest NodeTerminationState
+			queued bool
+		)
+		for states != nil || queued {
+			var send chan<- NodeTerminationState
+			if queued {
+				send = out
+			}
+			select {
+			case state, ok := <-states:
+				if !ok {
+					states = nil
+					continue
+				}
+				n.trackCancellation(state)
+				latest, queued = state, true
+			case send <- latest:
+				queued = false
+			}
+		}
+	}()
+	return out
+}
+
 func (n *nodeTerminationHandler) Start() error {
 	n.currentNodeState = n.terminationSource.GetState()
+	n.trackCancellation(n.currentNodeState)
+	states := n.watchState()
 	glog.V(4).Infof("Processing initial node state")
 	if err := n.processNodeState(); err != nil {
 		glog.V(2).Infof("Failed to process initial node state - %v", err)
 		return err
 	}
-	for state := range n.terminationSource.WatchState() {
+	for state := range states {
 		if !reflect.DeepEqual(state, n.currentNodeState) {
 			n.currentNodeState = state
+			n.drained = false
 			if err := wait.ExponentialBackoff(wait.Backoff{
 				Duration: time.Second,
 				Factor:   1.2,
@@ -0,0 +1,380 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeNode records the calls made to its NodeTaintHandler, PodEvictionHandler and NodeRebooter implementations.
+type fakeNode struct {
+	lock  sync.Mutex
+	calls []string
+	// evict is invoked by EvictPods if set.
+	evict func(stopCh <-chan struct{}) error
+	// rebootFailures is the number of times Reboot fails before it succeeds.
+	rebootFailures int
+	// markFailures is the number of times MarkLiveMigration fails before it succeeds.
+	markFailures int
+}
+
+func (f *fakeNode) record(call string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeNode) recorded() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *fakeNode) ApplyTaint() error {
+	f.record("taint")
+	return nil
+}
+
+func (f *fakeNode) ApplyAdvanceNoticeTaint(window MaintenanceWindow) error {
+	f.record("advance notice taint")
+	return nil
+}
+
+func (f *fakeNode) RemoveTaint() error {
+	f.record("untaint")
+	return nil
+}
+
+func (f *fakeNode) MarkLiveMigration(inProgress bool) error {
+	if inProgress {
+		f.record("mark live migration")
+	} else {
+		f.record("unmark live migration")
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.markFailures > 0 {
+		f.markFailures--
+		return errors.New("mark failed")
+	}
+	return nil
+}
+
+func (f *fakeNode) EvictPods(exclusions *PodExclusions, timeout time.Duration, stopCh <-chan struct{}) error {
+	f.record("evict")
+	if f.evict != nil {
+		return f.evict(stopCh)
+	}
+	return nil
+}
+
+func (f *fakeNode) Reboot() error {
+	f.record("reboot")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.rebootFailures > 0 {
+		f.rebootFailures--
+		return errors.New("reboot failed")
+	}
+	return nil
+}
+
+// fakeVolumeNode also waits for volumes to be detached.
+type fakeVolumeNode struct {
+	*fakeNode
+}
+
+func (f fakeVolumeNode) WaitForVolumeDetach(deadline time.Time) ([]string, error) {
+	f.record("wait for volume detach")
+	return nil, nil
+}
+
+// fakeLiveMigrationHook records its invocations, and fails the first `failures` of them.
+type fakeLiveMigrationHook struct {
+	calls    []string
+	failures int
+}
+
+func (f *fakeLiveMigrationHook) run(call string) error {
+	f.calls = append(f.calls, call)
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("hook failed")
+	}
+	return nil
+}
+
+func (f *fakeLiveMigrationHook) MigrationStarted() error {
+	return f.run("start")
+}
+
+func (f *fakeLiveMigrationHook) MigrationCompleted() error {
+	return f.run("end")
+}
+
+// fakeNotifier records the titles of notifications.
+type fakeNotifier struct {
+	titles []string
+}
+
+func (f *fakeNotifier) Notify(title string) error {
+	f.titles = append(f.titles, title)
+	return nil
+}
+
+func newFakeHandler(source NodeTerminationSource, node *fakeNode) *nodeTerminationHandler {
+	return NewNodeTerminationHandler(source, node, node, nil, nil, nil, node, "localhost", record.NewFakeRecorder(20)).(*nodeTerminationHandler)
+}
+
+func TestCancellationStopsEvictions(t *testing.T) {
+	source := newFakeSource(NodeTerminationState{PendingTermination: true, TerminationTime: time.Now().Add(time.Hour), NeedsReboot: true})
+	evicting := make(chan struct{})
+	node := &fakeNode{
+		evict: func(stopCh <-chan struct{}) error {
+			close(evicting)
+			select {
+			case <-stopCh:
+				return nil
+			case <-time.After(5 * time.Second):
+				return errors.New("evictions were not stopped")
+			}
+		},
+	}
+	handler := newFakeHandler(source, node)
+	done := make(chan error)
+	go func() {
+		done <- handler.Start()
+	}()
+	<-evicting
+	source.updates <- NodeTerminationState{}
+	close(source.updates)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// The node is neither rebooted nor left tainted.
+	if expected := []string{"unmark live migration", "taint", "evict", "untaint"}; !reflect.DeepEqual(node.recorded(), expected) {
+		t.Errorf("expected calls %v, got %v", expected, node.recorded())
+	}
+	if len(source.acknowledged) != 0 {
+		t.Errorf("expected the cancelled termination not to be acknowledged, got %v", source.acknowledged)
+	}
+}
+
+func TestWatchStateForwardsLatestState(t *testing.T) {
+	source := newFakeSource(NodeTerminationState{})
+	handler := newFakeHandler(source, &fakeNode{})
+	states := handler.watchState()
+	source.updates <- NodeTerminationState{PendingTermination: true, Source: "first"}
+	source.updates <- NodeTerminationState{PendingTermination: true, Source: "second"}
+	stopCh := handler.evictionStopCh()
+	if stopCh == nil || isStopped(stopCh) {
+		t.Fatal("expected evictions to be stoppable while a termination is pending")
+	}
+	source.updates <- NodeTerminationState{Source: "cancelled"}
+	// Intermediate states are dropped while the consumer is busy.
+	if state := <-states; state.Source != "cancelled" {
+		t.Errorf("expected the latest state to be forwarded, got %+v", state)
+	}
+	if !isStopped(stopCh) || handler.evictionStopCh() != nil {
+		t.Error("expected evictions to be stopped once the termination is cancelled")
+	}
+	close(source.updates)
+	if _, ok := <-states; ok {
+		t.Error("expected states to be closed along with the source")
+	}
+}
+
+func TestVolumesAreDetachedBeforeReboot(t *testing.T) {
+	source := newFakeSource(NodeTerminationState{PendingTermination: true, TerminationTime: time.Now().Add(time.Hour), NeedsReboot: true})
+	node := &fakeNode{}
+	handler := NewNodeTerminationHandler(source, node, fakeVolumeNode{node}, nil, nil, nil, node, "localhost", record.NewFakeRecorder(20))
+	done := make(chan error)
+	go func() {
+		done <- handler.Start()
+	}()
+	expected := []string{"unmark live migration", "taint", "evict", "wait for volume detach", "reboot"}
+	if err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(node.recorded()) >= len(expected), nil
+	}); err != nil {
+		t.Fatalf("expected the node to be rebooted, got calls %v", node.recorded())
+	}
+	close(source.updates)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if calls := node.recorded(); !reflect.DeepEqual(calls[:len(expected)], expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestRetriesDoNotEvictPodsAgain(t *testing.T) {
+	source := newFakeSource(NodeTerminationState{})
+	node := &fakeNode{rebootFailures: 1}
+	handler := newFakeHandler(source, node)
+	done := make(chan error)
+	go func() {
+		done <- handler.Start()
+	}()
+	source.updates <- NodeTerminationState{PendingTermination: true, TerminationTime: time.Now().Add(time.Hour), NeedsReboot: true}
+	expected := []string{"unmark live migration", "untaint", "taint", "evict", "reboot", "taint", "reboot"}
+	if err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(node.recorded()) >= len(expected), nil
+	}); err != nil {
+		t.Fatalf("expected the reboot to be retried, got calls %v", node.recorded())
+	}
+	close(source.updates)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// Pods are evicted, and the drain reported, once for the termination.
+	if calls := node.recorded(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestUpcomingMaintenanceIsAnnouncedOnce(t *testing.T) {
+	window := MaintenanceWindow{Start: time.Now().Add(time.Hour), End: time.Now().Add(2 * time.Hour)}
+	source := newFakeSource(NodeTerminationState{UpcomingMaintenance: &window})
+	node := &fakeNode{}
+	notifier := &fakeNotifier{}
+	handler := NewNodeTerminationHandler(source, node, node, nil, notifier, nil, node, "localhost", record.NewFakeRecorder(20))
+	done := make(chan error)
+	go func() {
+		done <- handler.Start()
+	}()
+	// Unrelated changes of the state do not announce the same window again.
+	source.updates <- NodeTerminationState{UpcomingMaintenance: &MaintenanceWindow{Start: window.Start, End: window.End}, LiveMigration: true}
+	rescheduled := MaintenanceWindow{Start: window.Start.Add(time.Hour), End: window.End.Add(time.Hour)}
+	source.updates <- NodeTerminationState{UpcomingMaintenance: &rescheduled, LiveMigration: true}
+	expected := []string{"unmark live migration", "advance notice taint", "mark live migration", "advance notice taint"}
+	if err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(node.recorded()) >= len(expected), nil
+	}); err != nil {
+		t.Fatalf("expected the rescheduled maintenance to be announced, got calls %v", node.recorded())
+	}
+	close(source.updates)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if calls := node.recorded(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+	if expected := []string{upcomingMaintenanceTitle, upcomingMaintenanceTitle}; !reflect.DeepEqual(notifier.titles, expected) {
+		t.Errorf("expected notifications %v, got %v", expected, notifier.titles)
+	}
+}
+
+func TestProcessLiveMigration(t *testing.T) {
+	node := &fakeNode{}
+	hook := &fakeLiveMigrationHook{}
+	handler := NewNodeTerminationHandler(newFakeSource(NodeTerminationState{}), node, node, nil, nil, hook, node, "localhost", record.NewFakeRecorder(20)).(*nodeTerminationHandler)
+	for _, inProgress := range []bool{false, true, true, false, false} {
+		if err := handler.processLiveMigration(inProgress); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Transitions are handled once, and annotations left behind by a previous run are removed on startup.
+	if expected := []string{"unmark live migration", "mark live migration", "unmark live migration"}; !reflect.DeepEqual(node.recorded(), expected) {
+		t.Errorf("expected calls %v, got %v", expected, node.recorded())
+	}
+	if expected := []string{"start", "end"}; !reflect.DeepEqual(hook.calls, expected) {
+		t.Errorf("expected hook calls %v, got %v", expected, hook.calls)
+	}
+}
+
+func TestLiveMigrationFailuresAreRetried(t *testing.T) {
+	for _, test := range []struct {
+		desc              string
+		markFailures      int
+		hookFailures      int
+		expectedCalls     []string
+		expectedHookCalls []string
+	}{
+		{
+			desc:              "mark failure",
+			markFailures:      1,
+			expectedCalls:     []string{"mark live migration", "mark live migration"},
+			expectedHookCalls: []string{"start"},
+		},
+		{
+			desc:              "hook failure",
+			hookFailures:      1,
+			expectedCalls:     []string{"mark live migration"},
+			expectedHookCalls: []string{"start", "start"},
+		},
+		{
+			desc:              "mark and hook failures",
+			markFailures:      1,
+			hookFailures:      1,
+			expectedCalls:     []string{"mark live migration", "mark live migration"},
+			expectedHookCalls: []string{"start", "start"},
+		},
+	} {
+		node := &fakeNode{markFailures: test.markFailures}
+		hook := &fakeLiveMigrationHook{failures: test.hookFailures}
+		handler := NewNodeTerminationHandler(newFakeSource(NodeTerminationState{}), node, node, nil, nil, hook, node, "localhost", record.NewFakeRecorder(20)).(*nodeTerminationHandler)
+		if err := handler.processLiveMigration(true); err == nil {
+			t.Errorf("%s: expected the failure to be reported", test.desc)
+		}
+		for i := 0; i < 2; i++ {
+			if err := handler.processLiveMigration(true); err != nil {
+				t.Errorf("%s: expected the retry to succeed, got %v", test.desc, err)
+			}
+		}
+		// The hook runs even if the node cannot be marked, and only what failed is retried.
+		if !reflect.DeepEqual(node.recorded(), test.expectedCalls) {
+			t.Errorf("%s: expected calls %v, got %v", test.desc, test.expectedCalls, node.recorded())
+		}
+		if !reflect.DeepEqual(hook.calls, test.expectedHookCalls) {
+			t.Errorf("%s: expected hook calls %v, got %v", test.desc, test.expectedHookCalls, hook.calls)
+		}
+	}
+}
+
+func TestLiveMigrationFailuresDoNotHoldBackTerminations(t *testing.T) {
+	source := newFakeSource(NodeTerminationState{PendingTermination: true, TerminationTime: time.Now().Add(time.Hour), LiveMigration: true})
+	node := &fakeNode{markFailures: 100}
+	hook := &fakeLiveMigrationHook{failures: 100}
+	recorder := record.NewFakeRecorder(20)
+	handler := NewNodeTerminationHandler(source, node, node, nil, nil, hook, node, "localhost", recorder)
+	done := make(chan error)
+	go func() {
+		done <- handler.Start()
+	}()
+	expected := []string{"mark live migration", "taint", "evict"}
+	if err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(node.recorded()) >= len(expected), nil
+	}); err != nil {
+		t.Fatalf("expected pods to be evicted, got calls %v", node.recorded())
+	}
+	close(source.updates)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if calls := node.recorded(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+	if len(recorder.Events) != 1 || !strings.Contains(<-recorder.Events, liveMigrationFailedReason) {
+		t.Error("expected the live migration failure to be recorded")
+	}
+}
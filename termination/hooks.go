@@ -0,0 +1,176 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// PreEvictionHookAnnotation declares a hook that is run before the pod is evicted, e.g.
+	// `{"exec": {"container": "trainer", "command": ["/bin/checkpoint"]}, "timeoutSeconds": 120}` or
+	// `{"http": {"method": "POST", "port": 8080, "path": "/checkpoint"}}`.
+	PreEvictionHookAnnotation = "node-termination-handler/pre-eviction-hook"
+	// hookSucceededReason is recorded on pods whose pre-eviction hook succeeded.
+	hookSucceededReason = "PreEvictionHookSucceeded"
+	// hookFailedReason is recorded on pods whose pre-eviction hook failed. Pods are evicted regardless.
+	hookFailedReason = "PreEvictionHookFailed"
+	// defaultHookTimeout bounds hooks that do not specify a timeout.
+	defaultHookTimeout = 30 * time.Second
+)
+
+// preEvictionHook is the value of PreEvictionHookAnnotation. Exactly one of `Exec` and `HTTP` must be set.
+type preEvictionHook struct {
+	Exec *execHook `json:"exec,omitempty"`
+	HTTP *httpHook `json:"http,omitempty"`
+	// TimeoutSeconds bounds the hook. Hooks never run past the deadline of the tier the pod is evicted in.
+	TimeoutSeconds int64 `json:"timeoutSeconds,omitempty"`
+}
+
+// execHook runs a command in a container of the pod.
+type execHook struct {
+	// Container defaults to the first container of the pod.
+	Container string   `json:"container,omitempty"`
+	Command   []string `json:"command"`
+}
+
+// httpHook sends a request to the pod. It succeeds if the response status is 2xx or 3xx.
+type httpHook struct {
+	// Method is either GET (the default) or POST.
+	Method string `json:"method,omitempty"`
+	Port   int    `json:"port"`
+	// Path defaults to `/`.
+	Path string `json:"path,omitempty"`
+}
+
+// parsePreEvictionHook returns the hook declared by `pod`, or nil if it does not declare any.
+func parsePreEvictionHook(pod v1.Pod) (*preEvictionHook, error) {
+	value, exists := pod.Annotations[PreEvictionHookAnnotation]
+	if !exists {
+		return nil, nil
+	}
+	var hook preEvictionHook
+	if err := json.Unmarshal([]byte(value), &hook); err != nil {
+		return nil, fmt.Errorf("invalid pre-eviction hook %q: %v", value, err)
+	}
+	if (hook.Exec == nil) == (hook.HTTP == nil) {
+		return nil, fmt.Errorf("pre-eviction hook must specify exactly one of exec and http")
+	}
+	if hook.TimeoutSeconds < 0 {
+		return nil, fmt.Errorf("negative pre-eviction hook timeout %d", hook.TimeoutSeconds)
+	}
+	if hook.Exec != nil {
+		if len(hook.Exec.Command) == 0 {
+			return nil, fmt.Errorf("pre-eviction exec hook must specify a command")
+		}
+		if hook.Exec.Container == "" && len(pod.Spec.Containers) > 0 {
+			hook.Exec.Container = pod.Spec.Containers[0].Name
+		}
+	}
+	if hook.HTTP != nil {
+		switch hook.HTTP.Method {
+		case "":
+			hook.HTTP.Method = http.MethodGet
+		case http.MethodGet, http.MethodPost:
+		default:
+			return nil, fmt.Errorf("unsupported pre-eviction hook method %q", hook.HTTP.Method)
+		}
+		if hook.HTTP.Port <= 0 || hook.HTTP.Port > 65535 {
+			return nil, fmt.Errorf("invalid pre-eviction hook port %d", hook.HTTP.Port)
+		}
+		if !strings.HasPrefix(hook.HTTP.Path, "/") {
+			hook.HTTP.Path = "/" + hook.HTTP.Path
+		}
+	}
+	return &hook, nil
+}
+
+// timeout returns how long the hook may run.
+func (h *preEvictionHook) timeout() time.Duration {
+	if h.TimeoutSeconds == 0 {
+		return defaultHookTimeout
+	}
+	return time.Duration(h.TimeoutSeconds) * time.Second
+}
+
+// preEvictionHookOf returns the hook declared by `pod`, or nil if it declares none. Invalid hooks are recorded as an
+// event on the pod and ignored.
+func (p *podEvictionHandler) preEvictionHookOf(pod v1.Pod) *preEvictionHook {
+	hook, err := parsePreEvictionHook(pod)
+	if err != nil {
+		glog.V(2).Infof("Not running pre-eviction hook of pod %q in namespace %q: %v", pod.Name, pod.Namespace, err)
+		p.recorder.Eventf(&pod, v1.EventTypeWarning, hookFailedReason, "Node %q is about to be terminated. Pre-eviction hook is invalid: %v.", p.node, err)
+		return nil
+	}
+	return hook
+}
+
+// runPreEvictionHookUntil runs `hook` of `pod` and waits for it to complete or for `deadline`.
+// The outcome of the hook is recorded as an event on the pod.
+func (p *podEvictionHandler) runPreEvictionHookUntil(pod v1.Pod, hook *preEvictionHook, deadline time.Time) {
+	timeout := hook.timeout()
+	if remaining := time.Until(deadline); remaining < timeout {
+		timeout = remaining
+	}
+	if timeout <= 0 {
+		glog.V(2).Infof("No time left to run pre-eviction hook of pod %q in namespace %q", pod.Name, pod.Namespace)
+		p.recorder.Eventf(&pod, v1.EventTypeWarning, hookFailedReason, "Node %q is about to be terminated. No time left to run pre-eviction hook.", p.node)
+		return
+	}
+	glog.V(4).Infof("Running pre-eviction hook of pod %q in namespace %q within %v", pod.Name, pod.Namespace, timeout)
+	if err := p.runPreEvictionHook(pod, hook, timeout); err != nil {
+		glog.V(2).Infof("Pre-eviction hook of pod %q in namespace %q failed: %v", pod.Name, pod.Namespace, err)
+		p.recorder.Eventf(&pod, v1.EventTypeWarning, hookFailedReason, "Node %q is about to be terminated. Pre-eviction hook failed: %v.", p.node, err)
+		return
+	}
+	p.recorder.Eventf(&pod, v1.EventTypeNormal, hookSucceededReason, "Node %q is about to be terminated. Pre-eviction hook succeeded.", p.node)
+}
+
+func (p *podEvictionHandler) runPreEvictionHook(pod v1.Pod, hook *preEvictionHook, timeout time.Duration) error {
+	if hook.Exec != nil {
+		if p.executor == nil {
+			return fmt.Errorf("exec hooks are not supported")
+		}
+		_, err := p.executor.Exec(pod.Namespace, pod.Name, hook.Exec.Container, hook.Exec.Command, timeout)
+		return err
+	}
+	if pod.Status.PodIP == "" {
+		return fmt.Errorf("pod has no IP address")
+	}
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(hook.HTTP.Port)), hook.HTTP.Path)
+	req, err := http.NewRequest(hook.HTTP.Method, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s %s returned %s", hook.HTTP.Method, url, resp.Status)
+	}
+	return nil
+}
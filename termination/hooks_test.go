@@ -0,0 +1,204 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+type fakeExecutor struct {
+	lock     sync.Mutex
+	commands map[string][]string
+	err      error
+	// delay is the time taken by each command.
+	delay time.Duration
+}
+
+func (f *fakeExecutor) Exec(namespace, name, container string, command []string, timeout time.Duration) (string, error) {
+	time.Sleep(f.delay)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.commands[namespace+"/"+name+"/"+container] = command
+	return "", f.err
+}
+
+func TestParsePreEvictionHook(t *testing.T) {
+	for _, test := range []struct {
+		hook        string
+		expected    *preEvictionHook
+		expectedErr bool
+	}{
+		{
+			hook:     `{"exec": {"command": ["/bin/checkpoint"]}}`,
+			expected: &preEvictionHook{Exec: &execHook{Container: "main", Command: []string{"/bin/checkpoint"}}},
+		},
+		{
+			hook:     `{"exec": {"container": "sidecar", "command": ["sync"]}, "timeoutSeconds": 120}`,
+			expected: &preEvictionHook{Exec: &execHook{Container: "sidecar", Command: []string{"sync"}}, TimeoutSeconds: 120},
+		},
+		{
+			hook:     `{"http": {"port": 8080, "path": "checkpoint"}}`,
+			expected: &preEvictionHook{HTTP: &httpHook{Method: "GET", Port: 8080, Path: "/checkpoint"}},
+		},
+		{hook: `{"http": {"method": "PUT", "port": 8080}}`, expectedErr: true},
+		{hook: `{"http": {"port": 0}}`, expectedErr: true},
+		{hook: `{"exec": {"command": []}}`, expectedErr: true},
+		{hook: `{"exec": {"command": ["sync"]}, "http": {"port": 8080}}`, expectedErr: true},
+		{hook: `{}`, expectedErr: true},
+		{hook: `{"exec": {"command": ["sync"]}, "timeoutSeconds": -1}`, expectedErr: true},
+		{hook: `checkpoint`, expectedErr: true},
+	} {
+		hook, err := parsePreEvictionHook(makePod(pod{name: "job", namespace: "default", nodeName: "localhost", annotations: map[string]string{PreEvictionHookAnnotation: test.hook}, containers: []string{"main", "sidecar"}, podIP: "127.0.0.1"}))
+		if test.expectedErr != (err != nil) {
+			t.Errorf("hook %q: expected error to be %v, got %v", test.hook, test.expectedErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(hook, test.expected) {
+			t.Errorf("hook %q: expected %+v, got %+v", test.hook, test.expected, hook)
+		}
+	}
+	if hook, err := parsePreEvictionHook(makePod(pod{name: "web"})); hook != nil || err != nil {
+		t.Errorf("expected pods without annotation to have no hook, got %+v, %v", hook, err)
+	}
+}
+
+func TestRunPreEvictionHooks(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		requests []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		lock.Unlock()
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+
+	pods := []v1.Pod{
+		makePod(pod{name: "trainer", namespace: "default", nodeName: "localhost", annotations: map[string]string{PreEvictionHookAnnotation: `{"exec": {"command": ["/bin/checkpoint"]}}`}, containers: []string{"main", "sidecar"}, podIP: "127.0.0.1"}),
+		makePod(pod{name: "web", namespace: "default", nodeName: "localhost", annotations: map[string]string{PreEvictionHookAnnotation: fmt.Sprintf(`{"http": {"method": "POST", "port": %d, "path": "/checkpoint"}}`, portNumber)}, containers: []string{"main", "sidecar"}, podIP: "127.0.0.1"}),
+		makePod(pod{name: "broken", namespace: "default", nodeName: "localhost", annotations: map[string]string{PreEvictionHookAnnotation: fmt.Sprintf(`{"http": {"port": %d, "path": "/broken"}}`, portNumber)}, containers: []string{"main", "sidecar"}, podIP: "127.0.0.1"}),
+		makePod(pod{name: "invalid", namespace: "default", nodeName: "localhost", annotations: map[string]string{PreEvictionHookAnnotation: `{}`}, containers: []string{"main", "sidecar"}, podIP: "127.0.0.1"}),
+		makePod(pod{name: "plain", namespace: "default", nodeName: "localhost"}),
+	}
+	executor := &fakeExecutor{commands: map[string][]string{}}
+	recorder := record.NewFakeRecorder(20)
+	evictionHandler := &podEvictionHandler{
+		node:     "localhost",
+		recorder: recorder,
+		executor: executor,
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	var hooks int
+	for _, pod := range pods {
+		if hook := evictionHandler.preEvictionHookOf(pod); hook != nil {
+			hooks++
+			evictionHandler.runPreEvictionHookUntil(pod, hook, deadline)
+		}
+	}
+	if hooks != 3 {
+		t.Fatalf("expected 3 hooks to be run, got %d", hooks)
+	}
+	if expected := map[string][]string{"default/trainer/main": {"/bin/checkpoint"}}; !reflect.DeepEqual(executor.commands, expected) {
+		t.Errorf("expected commands %v, got %v", expected, executor.commands)
+	}
+	if len(requests) != 2 {
+		t.Errorf("expected two HTTP hooks to be run, got %v", requests)
+	}
+	var succeeded, failed int
+	for len(recorder.Events) > 0 {
+		event := <-recorder.Events
+		if strings.Contains(event, hookSucceededReason) {
+			succeeded++
+		}
+		if strings.Contains(event, hookFailedReason) {
+			failed++
+		}
+	}
+	if succeeded != 2 || failed != 2 {
+		t.Errorf("expected 2 hooks to succeed and 2 to fail, got %d and %d", succeeded, failed)
+	}
+}
+
+func TestRunPreEvictionHooksAfterDeadline(t *testing.T) {
+	executor := &fakeExecutor{commands: map[string][]string{}}
+	recorder := record.NewFakeRecorder(20)
+	evictionHandler := &podEvictionHandler{
+		node:     "localhost",
+		recorder: recorder,
+		executor: executor,
+	}
+	trainer := makePod(pod{name: "trainer", namespace: "default", nodeName: "localhost", annotations: map[string]string{PreEvictionHookAnnotation: `{"exec": {"command": ["/bin/checkpoint"]}}`}, containers: []string{"main", "sidecar"}, podIP: "127.0.0.1"})
+	evictionHandler.runPreEvictionHookUntil(trainer, evictionHandler.preEvictionHookOf(trainer), time.Now().Add(-time.Second))
+	if len(executor.commands) != 0 {
+		t.Errorf("expected no hook to run past the deadline, got %v", executor.commands)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, hookFailedReason) {
+		t.Errorf("expected hook to be reported as failed, got %q", event)
+	}
+}
+
+func TestSlowPreEvictionHookHoldsBackOnlyItsPod(t *testing.T) {
+	trainer := makePod(pod{name: "trainer", namespace: "default", nodeName: "localhost", annotations: map[string]string{PreEvictionHookAnnotation: `{"exec": {"command": ["/bin/checkpoint"]}}`}, containers: []string{"main", "sidecar"}, podIP: "127.0.0.1"})
+	web := makePod(pod{name: "web", namespace: "default", nodeName: "localhost"})
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&v1.PodList{Items: []v1.Pod{trainer, web}})
+	evictionHandler := &podEvictionHandler{
+		client:       kubeClientset.CoreV1(),
+		policyClient: newFakePolicyClient(kubeClientset.CoreV1()),
+		node:         "localhost",
+		recorder:     record.NewFakeRecorder(20),
+		executor:     &fakeExecutor{commands: map[string][]string{}, delay: time.Second},
+		rateLimiter:  flowcontrol.NewFakeAlwaysRateLimiter(),
+	}
+	done := make(chan []v1.Pod)
+	go func() {
+		evicted, _ := evictionHandler.evictBatch([]v1.Pod{trainer, web}, 30, time.Now().Add(30*time.Second), make(chan struct{}, 1), nil)
+		done <- evicted
+	}()
+	time.Sleep(500 * time.Millisecond)
+	if _, err := kubeClientset.CoreV1().Pods("default").Get("web", metav1.GetOptions{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the pod without hook to be evicted while the hook is running, got %v", err)
+	}
+	if _, err := kubeClientset.CoreV1().Pods("default").Get("trainer", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the pod to be kept until its hook completed, got %v", err)
+	}
+	if evicted := <-done; len(evicted) != 2 {
+		t.Errorf("expected both pods to be evicted, got %d", len(evicted))
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	httpTriggerPath    = "/termination"
+	bearerPrefix       = "Bearer "
+	maxTriggerBodySize = 1 << 16
+	// minTriggerLeadTime is the least time before their deadline at which terminations can be scheduled, such that
+	// pods can be evicted at all.
+	minTriggerLeadTime = 30 * time.Second
+)
+
+// TerminationRequest is the document accepted by the HTTP trigger source to schedule a termination.
+type TerminationRequest struct {
+	// Deadline is the time at which the node is expected to be terminated.
+	Deadline time.Time `json:"deadline"`
+	// Reason is a human readable description of the termination.
+	Reason string `json:"reason"`
+	// NeedsReboot requests the node to be rebooted once all pods have been evicted.
+	NeedsReboot bool `json:"needsReboot"`
+}
+
+type httpTriggerSource struct {
+	sync.RWMutex
+	state         NodeTerminationState
+	updateChannel chan NodeTerminationState
+	// notify coalesces state changes such that requests do not block while the handler is busy.
+	notify   chan struct{}
+	listener net.Listener
+	token    string
+}
+
+// NewHTTPTriggerSource returns a termination source that lets external tooling schedule and cancel terminations
+// by issuing POST and DELETE requests to `/termination` on `address`.
+// Requests must either present `token` as a bearer token, or a client certificate verified by `tlsConfig`.
+// Bearer tokens are only accepted over TLS.
+func NewHTTPTriggerSource(nodeName, address, token string, tlsConfig *tls.Config) (NodeTerminationSource, error) {
+	mutualTLS := tlsConfig != nil && tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert
+	if token == "" && !mutualTLS {
+		return nil, errors.New("http trigger requires either a bearer token or verified client certificates")
+	}
+	if token != "" && tlsConfig == nil {
+		return nil, errors.New("http trigger refuses to accept a bearer token over plain http, a TLS certificate is required")
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return &httpTriggerSource{
+		state:         NodeTerminationState{NodeName: nodeName},
+		updateChannel: make(chan NodeTerminationState),
+		notify:        make(chan struct{}, 1),
+		listener:      listener,
+		token:         token,
+	}, nil
+}
+
+func (h *httpTriggerSource) authorized(r *http.Request) bool {
+	if h.token == "" {
+		// Client certificates have already been verified during the TLS handshake.
+		return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, bearerPrefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, bearerPrefix)), []byte(h.token)) == 1
+}
+
+func (h *httpTriggerSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != httpTriggerPath {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req TerminationRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTriggerBodySize)).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid termination request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Deadline.IsZero() {
+			http.Error(w, "termination request is missing a deadline", http.StatusBadRequest)
+			return
+		}
+		if time.Until(req.Deadline) < minTriggerLeadTime {
+			http.Error(w, fmt.Sprintf("termination deadline %v must be at least %v in the future", req.Deadline, minTriggerLeadTime), http.StatusBadRequest)
+			return
+		}
+		glog.Infof("Recording impending termination at %v requested by %s: %q", req.Deadline, r.RemoteAddr, req.Reason)
+		h.setState(true, req.Deadline, req.NeedsReboot, req.Reason)
+	case "DELETE":
+		glog.Infof("Removing impending termination records as requested by %s", r.RemoteAddr)
+		h.setState(false, time.Now(), false, "")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.GetState())
+}
+
+func (h *httpTriggerSource) setState(pending bool, terminationTime time.Time, needsReboot bool, reason string) {
+	h.Lock()
+	h.state.PendingTermination = pending
+	h.state.TerminationTime = terminationTime
+	h.state.NeedsReboot = needsReboot
+	h.state.Reason = reason
+	h.Unlock()
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (h *httpTriggerSource) WatchState() <-chan NodeTerminationState {
+	go func() {
+		server := &http.Server{Handler: h}
+		glog.Errorf("HTTP trigger stopped serving on %s - %v", h.listener.Addr(), server.Serve(h.listener))
+	}()
+	go func() {
+		for range h.notify {
+			h.updateChannel <- h.GetState()
+		}
+	}()
+	return h.updateChannel
+}
+
+func (h *httpTriggerSource) GetState() NodeTerminationState {
+	h.RLock()
+	defer h.RUnlock()
+	return h.state
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPTriggerSource(t *testing.T) {
+	if _, err := NewHTTPTriggerSource("localhost", "127.0.0.1:0", "", nil); err == nil {
+		t.Fatal("expected unauthenticated http trigger to be rejected")
+	}
+	if _, err := NewHTTPTriggerSource("localhost", "127.0.0.1:0", "secret", nil); err == nil {
+		t.Fatal("expected bearer tokens over plain http to be rejected")
+	}
+	source, err := NewHTTPTriggerSource("localhost", "127.0.0.1:0", "secret", &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Hour).Truncate(time.Second)
+	states := source.WatchState()
+	handler := source.(http.Handler)
+
+	for _, test := range []struct {
+		desc           string
+		method, token  string
+		body           string
+		expectedStatus int
+		expectedState  *NodeTerminationState
+	}{
+		{
+			desc:           "missing token",
+			method:         "POST",
+			body:           `{"deadline": "2018-06-01T10:00:00Z"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:           "wrong token",
+			method:         "POST",
+			token:          "guess",
+			body:           `{"deadline": "2018-06-01T10:00:00Z"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:           "missing deadline",
+			method:         "POST",
+			token:          "secret",
+			body:           `{"reason": "MIG recreation"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "past deadline",
+			method:         "POST",
+			token:          "secret",
+			body:           `{"deadline": "2018-06-01T10:00:00Z"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "deadline too close",
+			method:         "POST",
+			token:          "secret",
+			body:           fmt.Sprintf(`{"deadline": %q}`, time.Now().Add(time.Second).Format(time.RFC3339)),
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "scheduled termination",
+			method:         "POST",
+			token:          "secret",
+			body:           fmt.Sprintf(`{"deadline": %q, "reason": "MIG recreation", "needsReboot": true}`, deadline.Format(time.RFC3339)),
+			expectedStatus: http.StatusOK,
+			expectedState: &NodeTerminationState{
+				NodeName:           "localhost",
+				PendingTermination: true,
+				TerminationTime:    deadline,
+				NeedsReboot:        true,
+				Reason:             "MIG recreation",
+			},
+		},
+		{
+			desc:           "cancelled termination",
+			method:         "DELETE",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expectedState:  &NodeTerminationState{NodeName: "localhost"},
+		},
+	} {
+		req := httptest.NewRequest(test.method, httpTriggerPath, strings.NewReader(test.body))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		if resp.Code != test.expectedStatus {
+			t.Fatalf("%s: expected status %d, got %d", test.desc, test.expectedStatus, resp.Code)
+		}
+		if test.expectedState == nil {
+			continue
+		}
+		select {
+		case state := <-states:
+			if state.NodeName != test.expectedState.NodeName ||
+				state.PendingTermination != test.expectedState.PendingTermination ||
+				state.NeedsReboot != test.expectedState.NeedsReboot ||
+				state.Reason != test.expectedState.Reason ||
+				(state.PendingTermination && !state.TerminationTime.Equal(test.expectedState.TerminationTime)) {
+				t.Errorf("%s: expected state %+v, got %+v", test.desc, *test.expectedState, state)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for a state update", test.desc)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import "cloud.google.com/go/compute/metadata"
+
+// gceMetadataClient talks to the metadata server of the current GCE instance.
+// The server can be pointed at an emulator using the GCE_METADATA_HOST environment variable.
+type gceMetadataClient struct{}
+
+func NewGCEMetadataClient() MetadataClient {
+	return gceMetadataClient{}
+}
+
+func (gceMetadataClient) Get(suffix string) (string, error) {
+	return metadata.Get(suffix)
+}
+
+func (gceMetadataClient) Subscribe(suffix string, fn func(v string, ok bool) error) error {
+	return metadata.Subscribe(suffix, fn)
+}
+
+func (gceMetadataClient) InstanceName() (string, error) {
+	return metadata.InstanceName()
+}
+
+func (gceMetadataClient) Zone() (string, error) {
+	return metadata.Zone()
+}
+
+func (gceMetadataClient) ProjectID() (string, error) {
+	return metadata.ProjectID()
+}
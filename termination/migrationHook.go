@@ -0,0 +1,63 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	migrationStartedArg   = "start"
+	migrationCompletedArg = "end"
+)
+
+// commandLiveMigrationHook runs an external command around live migrations.
+type commandLiveMigrationHook struct {
+	command string
+	timeout time.Duration
+}
+
+// NewCommandLiveMigrationHook returns a hook that runs `command start` when a live migration is announced and
+// `command end` once it has completed. Each invocation is killed after `timeout`.
+func NewCommandLiveMigrationHook(command string, timeout time.Duration) LiveMigrationHook {
+	return &commandLiveMigrationHook{
+		command: command,
+		timeout: timeout,
+	}
+}
+
+func (c *commandLiveMigrationHook) MigrationStarted() error {
+	return c.run(migrationStartedArg)
+}
+
+func (c *commandLiveMigrationHook) MigrationCompleted() error {
+	return c.run(migrationCompletedArg)
+}
+
+func (c *commandLiveMigrationHook) run(arg string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, c.command, arg).CombinedOutput()
+	glog.V(4).Infof("Live migration hook %q %q output: %s", c.command, arg, out)
+	if err != nil {
+		return fmt.Errorf("%q %q failed: %v", c.command, arg, err)
+	}
+	return nil
+}
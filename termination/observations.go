@@ -0,0 +1,103 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ObservationStore remembers when termination sources first observed a pending termination, such that deadlines
+// derived from it stay accurate across restarts of the handler.
+type ObservationStore struct {
+	sync.Mutex
+	// path of the file observations are persisted to. Observations are only kept in memory if it is empty.
+	path         string
+	observations map[string]time.Time
+}
+
+// NewObservationStore returns a store persisted at `path`, loading any observations recorded by a previous run.
+func NewObservationStore(path string) (*ObservationStore, error) {
+	ret := &ObservationStore{
+		path:         path,
+		observations: map[string]time.Time{},
+	}
+	if path == "" {
+		return ret, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &ret.observations); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Observe returns the time at which the termination identified by `key` was first observed.
+// `now` is recorded and returned if the termination has not been observed before.
+func (o *ObservationStore) Observe(key string, now time.Time) time.Time {
+	o.Lock()
+	defer o.Unlock()
+	if observed, exists := o.observations[key]; exists {
+		return observed
+	}
+	o.observations[key] = now
+	o.save()
+	return now
+}
+
+// Forget drops the observation recorded for `key`, once the corresponding termination is no longer pending.
+func (o *ObservationStore) Forget(key string) {
+	o.Lock()
+	defer o.Unlock()
+	if _, exists := o.observations[key]; !exists {
+		return
+	}
+	delete(o.observations, key)
+	o.save()
+}
+
+// save persists all observations. It must be invoked with the lock held.
+// Failures are logged since losing an observation only degrades the accuracy of deadlines after a restart.
+func (o *ObservationStore) save() {
+	if o.path == "" {
+		return
+	}
+	b, err := json.Marshal(o.observations)
+	if err != nil {
+		glog.Errorf("Failed to encode termination observations: %v", err)
+		return
+	}
+	// Write to a temporary file first such that a crash never leaves a truncated file behind.
+	tmp := filepath.Join(filepath.Dir(o.path), "."+filepath.Base(o.path)+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		glog.Errorf("Failed to persist termination observations: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		glog.Errorf("Failed to persist termination observations: %v", err)
+	}
+}
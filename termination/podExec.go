@@ -0,0 +1,149 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	spdystream "k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// maxExecOutput bounds the output of commands that is kept around.
+const maxExecOutput = 4096
+
+// podExecutor runs commands through the `exec` subresource of pods, like `kubectl exec` does.
+type podExecutor struct {
+	config *rest.Config
+	client rest.Interface
+}
+
+// NewPodExecutor returns a PodExecutor that talks to the API server described by `config`.
+func NewPodExecutor(config *rest.Config) (PodExecutor, error) {
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &podExecutor{config: config, client: client.CoreV1().RESTClient()}, nil
+}
+
+func (p *podExecutor) Exec(namespace, name, container string, command []string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	url := p.client.Post().Namespace(namespace).Resource("pods").Name(name).SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec).URL()
+	transport, upgrader, err := p.roundTripperUntil(deadline)
+	if err != nil {
+		return "", err
+	}
+	executor, err := remotecommand.NewSPDYExecutorForTransports(transport, upgrader, "POST", url)
+	if err != nil {
+		return "", err
+	}
+	output := &execOutput{}
+	done := make(chan error, 1)
+	go func() {
+		done <- executor.Stream(remotecommand.StreamOptions{Stdout: output, Stderr: output})
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-done:
+	case <-timer.C:
+		// The connection is closed by the upgrader, should the API server not even have answered.
+		err = fmt.Errorf("command did not exit within %v", timeout)
+	}
+	if err != nil {
+		return output.String(), fmt.Errorf("failed to exec in container %q: %v", container, err)
+	}
+	return output.String(), nil
+}
+
+// roundTripperUntil returns a round tripper that authenticates requests to the API server and upgrades their
+// connections to SPDY. Connections fail to be established after `deadline`, and are closed once it expires.
+func (p *podExecutor) roundTripperUntil(deadline time.Time) (http.RoundTripper, spdy.Upgrader, error) {
+	tlsConfig, err := rest.TLSConfigFor(p.config)
+	if err != nil {
+		return nil, nil, err
+	}
+	upgradeRoundTripper := spdystream.NewSpdyRoundTripper(tlsConfig, true)
+	upgradeRoundTripper.Dialer = &net.Dialer{Deadline: deadline}
+	wrapper, err := rest.HTTPWrappersForConfig(p.config, upgradeRoundTripper)
+	if err != nil {
+		return nil, nil, err
+	}
+	return wrapper, deadlineUpgrader{Upgrader: upgradeRoundTripper, deadline: deadline}, nil
+}
+
+// deadlineUpgrader closes the connections it upgrades once `deadline` expires, which stops commands that outlive it.
+type deadlineUpgrader struct {
+	spdy.Upgrader
+	deadline time.Time
+}
+
+func (u deadlineUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := u.Upgrader.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.AfterFunc(time.Until(u.deadline), func() {
+		conn.Close()
+	})
+	go func() {
+		<-conn.CloseChan()
+		timer.Stop()
+	}()
+	return conn, nil
+}
+
+// execOutput collects the first maxExecOutput bytes written to the output streams of a command and drops the rest.
+type execOutput struct {
+	lock   sync.Mutex
+	output bytes.Buffer
+}
+
+func (o *execOutput) Write(data []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if remaining := maxExecOutput - o.output.Len(); remaining > 0 {
+		if len(data) > remaining {
+			o.output.Write(data[:remaining])
+		} else {
+			o.output.Write(data)
+		}
+	}
+	return len(data), nil
+}
+
+func (o *execOutput) String() string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.output.String()
+}
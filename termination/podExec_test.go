@@ -0,0 +1,73 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+func TestExecOutputIsBounded(t *testing.T) {
+	output := &execOutput{}
+	chunk := strings.Repeat("x", maxExecOutput/2+1)
+	for i := 0; i < 3; i++ {
+		if n, err := output.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("expected output to be accepted, got %d, %v", n, err)
+		}
+	}
+	if len(output.String()) != maxExecOutput {
+		t.Errorf("expected %d bytes of output to be kept, got %d", maxExecOutput, len(output.String()))
+	}
+}
+
+// fakeConnection is an upgraded connection that can only be closed.
+type fakeConnection struct {
+	httpstream.Connection
+	closed chan bool
+}
+
+func (f *fakeConnection) Close() error {
+	close(f.closed)
+	return nil
+}
+
+func (f *fakeConnection) CloseChan() <-chan bool {
+	return f.closed
+}
+
+type fakeUpgrader struct {
+	conn *fakeConnection
+}
+
+func (f fakeUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	return f.conn, nil
+}
+
+func TestUpgradedConnectionsAreClosedAtDeadline(t *testing.T) {
+	conn := &fakeConnection{closed: make(chan bool)}
+	upgrader := deadlineUpgrader{Upgrader: fakeUpgrader{conn}, deadline: time.Now().Add(100 * time.Millisecond)}
+	if _, err := upgrader.NewConnection(nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-conn.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the connection to be closed once the deadline expired")
+	}
+}
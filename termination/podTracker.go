@@ -0,0 +1,204 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// watchRetryInterval is the time to wait before watching pods again after the watch failed.
+const watchRetryInterval = time.Second
+
+// podTracker follows the pods of a node through a single watch, such that waiting for pods to be deleted does not
+// require polling the API server for every pod.
+type podTracker struct {
+	client  corev1.CoreV1Interface
+	options metav1.ListOptions
+	stopCh  chan struct{}
+
+	lock sync.Mutex
+	// pods maps the namespace and name of the pods on the node to their UID.
+	pods map[string]types.UID
+	// resourceVersion is the version of the pods the watch resumes from.
+	resourceVersion string
+	// changed is closed and replaced whenever pods are updated.
+	changed chan struct{}
+}
+
+// newPodTracker lists the pods of `node` and starts watching them. It returns the pods found on the node.
+func newPodTracker(client corev1.CoreV1Interface, node string) (*podTracker, []v1.Pod, error) {
+	t := &podTracker{
+		client:  client,
+		options: metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node).String()},
+		stopCh:  make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	pods, err := t.list()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The first watch is started right away for pods deleted from now on to be noticed.
+	w, err := t.startWatch()
+	if err != nil {
+		return nil, nil, err
+	}
+	go t.run(w)
+	return t, pods, nil
+}
+
+// stop stops watching pods.
+func (t *podTracker) stop() {
+	close(t.stopCh)
+}
+
+// list replaces the tracked pods by the ones currently on the node.
+func (t *podTracker) list() ([]v1.Pod, error) {
+	pods, err := t.client.Pods(metav1.NamespaceAll).List(t.options)
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pods = map[string]types.UID{}
+	for _, pod := range pods.Items {
+		t.pods[podKey(pod)] = pod.UID
+	}
+	t.resourceVersion = pods.ResourceVersion
+	t.notify()
+	return pods.Items, nil
+}
+
+// run applies pod updates from `w`, and from new watches once it ends, until the tracker is stopped.
+func (t *podTracker) run(w watch.Interface) {
+	for {
+		t.consume(w)
+		for w = nil; w == nil; {
+			select {
+			case <-t.stopCh:
+				return
+			case <-time.After(watchRetryInterval):
+			}
+			var err error
+			if w, err = t.startWatch(); err != nil {
+				glog.V(2).Infof("Failed to watch pods - %v", err)
+			}
+		}
+	}
+}
+
+// startWatch watches pods from the version they were last seen at.
+func (t *podTracker) startWatch() (watch.Interface, error) {
+	t.lock.Lock()
+	options := t.options
+	options.ResourceVersion = t.resourceVersion
+	t.lock.Unlock()
+	return t.client.Pods(metav1.NamespaceAll).Watch(options)
+}
+
+// consume applies pod updates until `w` ends or the tracker is stopped.
+func (t *podTracker) consume(w watch.Interface) {
+	defer w.Stop()
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				// Watches are closed by the API server after a while.
+				return
+			}
+			if event.Type == watch.Error {
+				status, _ := event.Object.(*metav1.Status)
+				glog.V(2).Infof("Watching pods failed - %v", status)
+				if status != nil && status.Code == http.StatusGone {
+					// The resource version to resume from is too old.
+					if _, err := t.list(); err != nil {
+						glog.V(2).Infof("Failed to list pods - %v", err)
+					}
+				}
+				return
+			}
+			if pod, ok := event.Object.(*v1.Pod); ok {
+				t.update(event.Type, pod)
+			}
+		}
+	}
+}
+
+func (t *podTracker) update(eventType watch.EventType, pod *v1.Pod) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if eventType == watch.Deleted {
+		if t.pods[podKey(*pod)] == pod.UID {
+			delete(t.pods, podKey(*pod))
+		}
+	} else {
+		t.pods[podKey(*pod)] = pod.UID
+	}
+	if pod.ResourceVersion != "" {
+		t.resourceVersion = pod.ResourceVersion
+	}
+	t.notify()
+}
+
+// notify wakes up goroutines waiting for pods to be deleted. The lock must be held.
+func (t *podTracker) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// waitForDeletion waits for all `pods` to be deleted. It returns the pods that still exist after `timeout`, or once
+// `stopCh` is closed. Pods replaced by pods of the same name are considered deleted.
+func (t *podTracker) waitForDeletion(pods []v1.Pod, timeout time.Duration, stopCh <-chan struct{}) []v1.Pod {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		t.lock.Lock()
+		var remaining []v1.Pod
+		for _, pod := range pods {
+			if uid, exists := t.pods[podKey(pod)]; exists && uid == pod.UID {
+				remaining = append(remaining, pod)
+			}
+		}
+		changed := t.changed
+		t.lock.Unlock()
+		if len(remaining) == 0 {
+			return nil
+		}
+		pods = remaining
+		select {
+		case <-changed:
+		case <-timer.C:
+			return remaining
+		case <-stopCh:
+			return remaining
+		}
+	}
+}
+
+func podKey(pod v1.Pod) string {
+	return pod.Namespace + "/" + pod.Name
+}
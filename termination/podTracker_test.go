@@ -0,0 +1,105 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+func TestPodTrackerWaitsForDeletion(t *testing.T) {
+	web, db := makePod(pod{name: "web", namespace: "default", nodeName: "localhost", uid: "1"}), makePod(pod{name: "db", namespace: "default", nodeName: "localhost", uid: "2"})
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&v1.PodList{Items: []v1.Pod{web, db}})
+	tracker, pods, err := newPodTracker(kubeClientset.CoreV1(), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.stop()
+	if len(pods) != 2 {
+		t.Fatalf("expected 2 pods on the node, got %d", len(pods))
+	}
+	time.AfterFunc(100*time.Millisecond, func() {
+		kubeClientset.CoreV1().Pods("default").Delete("web", nil)
+		// A replacement pod with the same name is not the pod that was waited for.
+		kubeClientset.CoreV1().Pods("default").Delete("db", nil)
+		replacement := makePod(pod{name: "db", namespace: "default", nodeName: "localhost", uid: "3"})
+		kubeClientset.CoreV1().Pods("default").Create(&replacement)
+	})
+	if remaining := tracker.waitForDeletion([]v1.Pod{web, db}, 5*time.Second, nil); len(remaining) != 0 {
+		t.Errorf("expected all pods to be deleted, got %v remaining", remaining)
+	}
+	var gets, lists, watches int
+	for _, action := range kubeClientset.Actions() {
+		if action.GetResource().Resource != "pods" {
+			continue
+		}
+		switch action.GetVerb() {
+		case "get":
+			gets++
+		case "list":
+			lists++
+		case "watch":
+			watches++
+		}
+	}
+	if gets != 0 || lists != 1 || watches != 1 {
+		t.Errorf("expected pods to be listed and watched once, got %d gets, %d lists and %d watches", gets, lists, watches)
+	}
+}
+
+func TestPodTrackerTimesOut(t *testing.T) {
+	web := makePod(pod{name: "web", namespace: "default", nodeName: "localhost", uid: "1"})
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&v1.PodList{Items: []v1.Pod{web}})
+	tracker, _, err := newPodTracker(kubeClientset.CoreV1(), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.stop()
+	if remaining := tracker.waitForDeletion([]v1.Pod{web}, 100*time.Millisecond, nil); len(remaining) != 1 {
+		t.Errorf("expected the pod to remain, got %v", remaining)
+	}
+	if remaining := tracker.waitForDeletion([]v1.Pod{web}, -time.Second, nil); len(remaining) != 1 {
+		t.Errorf("expected the pod to remain, got %v", remaining)
+	}
+}
+
+func TestPodTrackerRelistsExpiredWatches(t *testing.T) {
+	web := makePod(pod{name: "web", namespace: "default", nodeName: "localhost", uid: "1"})
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&v1.PodList{Items: []v1.Pod{web}})
+	watcher := watch.NewFake()
+	kubeClientset.PrependWatchReactor("pods", func(action core.Action) (bool, watch.Interface, error) {
+		return true, watcher, nil
+	})
+	tracker, _, err := newPodTracker(kubeClientset.CoreV1(), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.stop()
+	// The pod is deleted without the watch noticing.
+	if err := kubeClientset.CoreV1().Pods("default").Delete("web", nil); err != nil {
+		t.Fatal(err)
+	}
+	watcher.Error(&metav1.Status{Status: metav1.StatusFailure, Code: http.StatusGone, Reason: metav1.StatusReasonGone})
+	if remaining := tracker.waitForDeletion([]v1.Pod{web}, 5*time.Second, nil); len(remaining) != 0 {
+		t.Errorf("expected the pod to be deleted, got %v remaining", remaining)
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// drainReportReason is recorded on the node once pods have been evicted, summarizing the drain report.
+	drainReportReason = "NodeTerminationDrainReport"
+	// drainReportConfigMapPrefix prefixes the name of the ConfigMaps reports are persisted in, followed by the node name.
+	drainReportConfigMapPrefix = "node-termination-report-"
+	// drainReportKeyFormat formats the start of drains into ConfigMap keys.
+	drainReportKeyFormat = "20060102T150405Z"
+	// maxDrainReports is the number of reports kept for every node. Older reports are dropped.
+	maxDrainReports = 5
+	// drainReportLabel is set on the ConfigMaps reports are persisted in, such that stale ones can be found.
+	drainReportLabel = "node-termination-handler/drain-report"
+	// drainReportRetention is how long the ConfigMap of a node is kept after its last report. Nodes are usually gone
+	// by then, and nothing else deletes their ConfigMap.
+	drainReportRetention = 7 * 24 * time.Hour
+)
+
+// DrainReport describes what was done to the pods of a node to handle a termination.
+type DrainReport struct {
+	Node     string    `json:"node"`
+	Started  time.Time `json:"started"`
+	Deadline time.Time `json:"deadline"`
+	Finished time.Time `json:"finished"`
+	// InProgress is set on the reports persisted while pods are still being evicted. Finished is unset then.
+	InProgress bool `json:"inProgress,omitempty"`
+	// Cancelled is set if the termination was cancelled before all pods were evicted.
+	Cancelled bool `json:"cancelled,omitempty"`
+	// Error is set if evictions stopped because of an error.
+	Error string `json:"error,omitempty"`
+	// Shadow is set if pods were not actually evicted. The report then describes how they would have been evicted.
+	Shadow bool             `json:"shadow,omitempty"`
+	Pods   []PodDrainReport `json:"pods"`
+}
+
+// PodDrainReport describes what was done to a pod.
+type PodDrainReport struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Tier is the description of the tier the pod was evicted in.
+	Tier string `json:"tier,omitempty"`
+	// GracePeriodSeconds is the grace period the pod was given.
+	GracePeriodSeconds *int64 `json:"gracePeriodSeconds,omitempty"`
+	// Issued is when the eviction of the pod was issued, or would have been in shadow mode.
+	Issued *time.Time `json:"issued,omitempty"`
+	// FinishedInTime is set if the pod was gone by the end of its grace period.
+	FinishedInTime bool `json:"finishedInTime"`
+	// SkipReason is set for pods that were not evicted.
+	SkipReason string `json:"skipReason,omitempty"`
+	// ForceReasons lists why the pod was deleted forcefully, if it was.
+	ForceReasons []string `json:"forceReasons,omitempty"`
+	// Error is set if the pod could not be evicted.
+	Error string `json:"error,omitempty"`
+}
+
+// drainReporter collects the report of a drain. It is safe for concurrent use, and nil reporters ignore all records.
+type drainReporter struct {
+	lock   sync.Mutex
+	report DrainReport
+	pods   map[string]*PodDrainReport
+}
+
+func newDrainReporter(node string, start, deadline time.Time) *drainReporter {
+	return &drainReporter{
+		report: DrainReport{Node: node, Started: start, Deadline: deadline},
+		pods:   map[string]*PodDrainReport{},
+	}
+}
+
+// covers returns true if the report is about a drain ending at `deadline`. Drains retried for the same termination
+// complete the report of the first attempt, such that a single report is published for every termination.
+func (r *drainReporter) covers(deadline time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	drift := r.report.Deadline.Sub(deadline)
+	return drift > -time.Second && drift < time.Second
+}
+
+// pod returns the report of `pod`. The lock must be held.
+func (r *drainReporter) pod(pod v1.Pod) *PodDrainReport {
+	key := podKey(pod)
+	if _, exists := r.pods[key]; !exists {
+		r.pods[key] = &PodDrainReport{Namespace: pod.Namespace, Name: pod.Name}
+	}
+	return r.pods[key]
+}
+
+func (r *drainReporter) skipped(pod v1.Pod, reason string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pod(pod).SkipReason = reason
+}
+
+func (r *drainReporter) assigned(pods []v1.Pod, tier string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, pod := range pods {
+		r.pod(pod).Tier = tier
+	}
+}
+
+func (r *drainReporter) issued(pod v1.Pod, gracePeriod int64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	report := r.pod(pod)
+	report.GracePeriodSeconds = &gracePeriod
+	report.Issued = &now
+}
+
+// planned records that `pod` would be evicted at `at` within `gracePeriod` in shadow mode.
+func (r *drainReporter) planned(pod v1.Pod, at time.Time, gracePeriod int64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	report := r.pod(pod)
+	report.GracePeriodSeconds = &gracePeriod
+	report.Issued = &at
+}
+
+func (r *drainReporter) forced(pod v1.Pod, reason string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	report := r.pod(pod)
+	report.ForceReasons = append(report.ForceReasons, reason)
+}
+
+func (r *drainReporter) failed(pod v1.Pod, err error) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pod(pod).Error = err.Error()
+}
+
+// finished records whether `pods` were gone by the end of their grace period.
+func (r *drainReporter) finished(pods []v1.Pod, inTime bool) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, pod := range pods {
+		r.pod(pod).FinishedInTime = inTime
+	}
+}
+
+// complete returns the report with pods sorted by namespace and name.
+func (r *drainReporter) complete(cancelled bool, err error) DrainReport {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	report := r.collect()
+	report.Finished = time.Now()
+	report.Cancelled = cancelled
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report
+}
+
+// progress returns the report of the drain so far.
+func (r *drainReporter) progress() DrainReport {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	report := r.collect()
+	report.InProgress = true
+	return report
+}
+
+// collect returns the report with pods sorted by namespace and name. The lock must be held.
+func (r *drainReporter) collect() DrainReport {
+	report := r.report
+	report.Pods = nil
+	for _, pod := range r.pods {
+		report.Pods = append(report.Pods, *pod)
+	}
+	sort.Slice(report.Pods, func(i, j int) bool {
+		if report.Pods[i].Namespace != report.Pods[j].Namespace {
+			return report.Pods[i].Namespace < report.Pods[j].Namespace
+		}
+		return report.Pods[i].Name < report.Pods[j].Name
+	})
+	return report
+}
+
+// persistProgress persists the report of the ongoing drain in a ConfigMap in `reportNamespace`, unless empty, such that
+// it is available even if the node is terminated before evictions complete. It is replaced by the final report.
+func (p *podEvictionHandler) persistProgress() {
+	if p.report == nil || p.reportNamespace == "" {
+		return
+	}
+	report := p.report.progress()
+	data, err := json.Marshal(report)
+	if err != nil {
+		glog.Errorf("Failed to encode drain report: %v", err)
+		return
+	}
+	if err := p.persistReport(report, string(data)); err != nil {
+		glog.Errorf("Failed to persist drain report: %v", err)
+	}
+}
+
+// publishReport summarizes `report` in an event on the node and persists it in a ConfigMap in `reportNamespace`, unless empty.
+// The ConfigMaps of other nodes are deleted once they have not been reported to for drainReportRetention, unless
+// `report` is a shadow report.
+func (p *podEvictionHandler) publishReport(report DrainReport) {
+	var evicted, late, forced, skipped, failed int
+	for _, pod := range report.Pods {
+		switch {
+		case pod.SkipReason != "":
+			skipped++
+		case pod.Error != "":
+			failed++
+		case pod.Issued != nil:
+			evicted++
+			if !pod.FinishedInTime {
+				late++
+			}
+			if len(pod.ForceReasons) > 0 {
+				forced++
+			}
+		}
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		glog.Errorf("Failed to encode drain report: %v", err)
+		return
+	}
+	glog.V(2).Infof("Drain report: %s", data)
+	location := "in logs"
+	if p.reportNamespace != "" {
+		location = "in ConfigMap " + p.reportNamespace + "/" + drainReportConfigMapPrefix + p.node
+		// Shadow mode leaves the reports of other nodes alone.
+		if !report.Shadow {
+			if err := p.collectReports(); err != nil {
+				glog.Errorf("Failed to delete stale drain reports: %v", err)
+			}
+		}
+		if err := p.persistReport(report, string(data)); err != nil {
+			glog.Errorf("Failed to persist drain report: %v", err)
+			location = "in logs"
+		}
+	}
+	node := &v1.ObjectReference{Kind: "Node", Name: p.node, UID: types.UID(p.node)}
+	if report.Shadow {
+		p.recorder.Eventf(node, v1.EventTypeNormal, shadowPlanReason, "Shadow mode: would evict %d pods prior to node termination and skip %d. Full plan %s.", evicted, skipped, location)
+		return
+	}
+	eventType := v1.EventTypeNormal
+	if late > 0 || forced > 0 || failed > 0 || report.Error != "" {
+		eventType = v1.EventTypeWarning
+	}
+	p.recorder.Eventf(node, eventType, drainReportReason, "Evicted %d pods prior to node termination: %d did not exit within their grace period, %d were deleted forcefully, %d could not be evicted and %d were skipped. Full report %s.", evicted, late, forced, failed, skipped, location)
+}
+
+// persistReport adds `data` to the ConfigMap holding the reports of the node, dropping the oldest reports.
+// Reports of the same drain replace one another.
+func (p *podEvictionHandler) persistReport(report DrainReport, data string) error {
+	name := drainReportConfigMapPrefix + p.node
+	key := report.Started.UTC().Format(drainReportKeyFormat)
+	configMaps := p.client.ConfigMaps(p.reportNamespace)
+	configMap, err := configMaps.Get(name, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		_, err = configMaps.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: p.reportNamespace,
+				Labels:    map[string]string{drainReportLabel: "true"},
+			},
+			Data: map[string]string{key: data},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if configMap.Labels == nil {
+		configMap.Labels = map[string]string{}
+	}
+	configMap.Labels[drainReportLabel] = "true"
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[key] = data
+	var keys []string
+	for k := range configMap.Data {
+		keys = append(keys, k)
+	}
+	// Keys sort chronologically.
+	sort.Strings(keys)
+	for len(keys) > maxDrainReports {
+		delete(configMap.Data, keys[0])
+		keys = keys[1:]
+	}
+	_, err = configMaps.Update(configMap)
+	return err
+}
+
+// collectReports deletes the ConfigMaps of nodes whose last report is older than drainReportRetention.
+func (p *podEvictionHandler) collectReports() error {
+	configMaps := p.client.ConfigMaps(p.reportNamespace)
+	list, err := configMaps.List(metav1.ListOptions{LabelSelector: drainReportLabel})
+	if err != nil {
+		return err
+	}
+	for _, configMap := range list.Items {
+		if configMap.Name == drainReportConfigMapPrefix+p.node || time.Since(lastReportTime(configMap)) < drainReportRetention {
+			continue
+		}
+		glog.V(4).Infof("Deleting stale drain reports %q", configMap.Name)
+		if err := configMaps.Delete(configMap.Name, nil); err != nil && !apierrs.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastReportTime returns when the last report persisted in `configMap` started, or when it was created if it holds no
+// report.
+func lastReportTime(configMap v1.ConfigMap) time.Time {
+	last := configMap.CreationTimestamp.Time
+	for key := range configMap.Data {
+		if started, err := time.Parse(drainReportKeyFormat, key); err == nil && started.After(last) {
+			last = started
+		}
+	}
+	return last
+}
@@ -0,0 +1,252 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func TestEvictionsPublishDrainReport(t *testing.T) {
+	succeededPod := makePod(pod{name: "job", namespace: "default", nodeName: "localhost"})
+	succeededPod.Status.Phase = v1.PodSucceeded
+	regularPod := makePod(pod{name: "web", namespace: "default", nodeName: "localhost", terminationGracePeriod: int64Ptr(10)})
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&v1.PodList{Items: []v1.Pod{succeededPod, regularPod}})
+	recorder := record.NewFakeRecorder(20)
+	evictionHandler := &podEvictionHandler{
+		client:                 kubeClientset.CoreV1(),
+		policyClient:           newFakePolicyClient(kubeClientset.CoreV1()),
+		node:                   "localhost",
+		recorder:               recorder,
+		maxConcurrentEvictions: 1,
+		rateLimiter:            flowcontrol.NewFakeAlwaysRateLimiter(),
+		phases:                 defaultEvictionPhases(t),
+		reportNamespace:        "kube-system",
+	}
+	if err := evictionHandler.EvictPods(nil, 30*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	configMap, err := kubeClientset.CoreV1().ConfigMaps("kube-system").Get(drainReportConfigMapPrefix+"localhost", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configMap.Data) != 1 {
+		t.Fatalf("expected a single report, got %d", len(configMap.Data))
+	}
+	var report DrainReport
+	for _, data := range configMap.Data {
+		if err := json.Unmarshal([]byte(data), &report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if report.Node != "localhost" || report.Cancelled || report.Error != "" {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if len(report.Pods) != 2 {
+		t.Fatalf("expected 2 pods in the report, got %+v", report.Pods)
+	}
+	if job := report.Pods[0]; job.Name != "job" || job.SkipReason == "" || job.Issued != nil {
+		t.Errorf("expected the succeeded pod to be skipped, got %+v", job)
+	}
+	web := report.Pods[1]
+	if web.Name != "web" || web.Tier == "" || web.Issued == nil || !web.FinishedInTime || len(web.ForceReasons) != 0 {
+		t.Errorf("expected the regular pod to be evicted in time, got %+v", web)
+	}
+	if web.GracePeriodSeconds == nil || *web.GracePeriodSeconds != 10 {
+		t.Errorf("expected the regular pod to be given its termination grace period, got %v", web.GracePeriodSeconds)
+	}
+	var summarized bool
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.Contains(event, drainReportReason) {
+			summarized = strings.HasPrefix(event, v1.EventTypeNormal)
+		}
+	}
+	if !summarized {
+		t.Error("expected the report to be summarized in a normal event")
+	}
+}
+
+func TestPersistReportKeepsLastReports(t *testing.T) {
+	kubeClientset := fakekubeclientset.NewSimpleClientset()
+	evictionHandler := &podEvictionHandler{
+		client:          kubeClientset.CoreV1(),
+		node:            "localhost",
+		reportNamespace: "kube-system",
+	}
+	start := time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < maxDrainReports+2; i++ {
+		report := DrainReport{Node: "localhost", Started: start.Add(time.Duration(i) * time.Hour)}
+		if err := evictionHandler.persistReport(report, "{}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configMap, err := kubeClientset.CoreV1().ConfigMaps("kube-system").Get(drainReportConfigMapPrefix+"localhost", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configMap.Data) != maxDrainReports {
+		t.Fatalf("expected %d reports to be kept, got %d", maxDrainReports, len(configMap.Data))
+	}
+	for _, key := range []string{"20180601T100000Z", "20180601T110000Z"} {
+		if _, exists := configMap.Data[key]; exists {
+			t.Errorf("expected the oldest report %q to be dropped", key)
+		}
+	}
+	if _, exists := configMap.Data["20180601T160000Z"]; !exists {
+		t.Error("expected the latest report to be kept")
+	}
+}
+
+func TestRetriedEvictionsPublishOneReport(t *testing.T) {
+	regularPod := makePod(pod{name: "web", namespace: "default", nodeName: "localhost"})
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&v1.PodList{Items: []v1.Pod{regularPod}})
+	evictionHandler := &podEvictionHandler{
+		client:                 kubeClientset.CoreV1(),
+		policyClient:           newFakePolicyClient(kubeClientset.CoreV1()),
+		node:                   "localhost",
+		recorder:               record.NewFakeRecorder(20),
+		maxConcurrentEvictions: 1,
+		rateLimiter:            flowcontrol.NewFakeAlwaysRateLimiter(),
+		phases:                 defaultEvictionPhases(t),
+		reportNamespace:        "kube-system",
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for i := 0; i < 2; i++ {
+		if err := evictionHandler.EvictPods(nil, time.Until(deadline), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configMap, err := kubeClientset.CoreV1().ConfigMaps("kube-system").Get(drainReportConfigMapPrefix+"localhost", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configMap.Data) != 1 {
+		t.Errorf("expected a single report for the termination, got %d", len(configMap.Data))
+	}
+	// A later termination is reported separately.
+	time.Sleep(time.Second)
+	if err := evictionHandler.EvictPods(nil, 30*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if configMap, err = kubeClientset.CoreV1().ConfigMaps("kube-system").Get(drainReportConfigMapPrefix+"localhost", metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(configMap.Data) != 2 {
+		t.Errorf("expected a report for each termination, got %d", len(configMap.Data))
+	}
+}
+
+func TestPublishReportDeletesStaleReports(t *testing.T) {
+	now := time.Now()
+	makeReports := func(node string, started time.Time) *v1.ConfigMap {
+		return &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      drainReportConfigMapPrefix + node,
+				Namespace: "kube-system",
+				Labels:    map[string]string{drainReportLabel: "true"},
+			},
+			Data: map[string]string{started.UTC().Format(drainReportKeyFormat): "{}"},
+		}
+	}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(
+		makeReports("localhost", now.Add(-30*24*time.Hour)),
+		makeReports("gone", now.Add(-30*24*time.Hour)),
+		makeReports("recent", now.Add(-time.Hour)),
+	)
+	evictionHandler := &podEvictionHandler{
+		client:          kubeClientset.CoreV1(),
+		node:            "localhost",
+		recorder:        record.NewFakeRecorder(20),
+		reportNamespace: "kube-system",
+	}
+	evictionHandler.publishReport(DrainReport{Node: "localhost", Started: now})
+	configMaps, err := kubeClientset.CoreV1().ConfigMaps("kube-system").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, configMap := range configMaps.Items {
+		names = append(names, configMap.Name)
+	}
+	sort.Strings(names)
+	if expected := []string{drainReportConfigMapPrefix + "localhost", drainReportConfigMapPrefix + "recent"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected reports %v to be kept, got %v", expected, names)
+	}
+}
+
+func TestDrainReportIsPersistedWhileEvicting(t *testing.T) {
+	regularPod := makePod(pod{name: "web", namespace: "default", nodeName: "localhost"})
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&v1.PodList{Items: []v1.Pod{regularPod}})
+	policyClient := newFakePolicyClient(kubeClientset.CoreV1())
+	// The pod outlives its eviction, which then lasts until the end of its tier.
+	policyClient.evictions.stuck["web"] = true
+	evictionHandler := &podEvictionHandler{
+		client:                 kubeClientset.CoreV1(),
+		policyClient:           policyClient,
+		node:                   "localhost",
+		recorder:               record.NewFakeRecorder(20),
+		maxConcurrentEvictions: 1,
+		rateLimiter:            flowcontrol.NewFakeAlwaysRateLimiter(),
+		phases:                 defaultEvictionPhases(t),
+		reportNamespace:        "kube-system",
+	}
+	getReport := func() (DrainReport, error) {
+		var report DrainReport
+		configMap, err := kubeClientset.CoreV1().ConfigMaps("kube-system").Get(drainReportConfigMapPrefix+"localhost", metav1.GetOptions{})
+		if err != nil {
+			return report, err
+		}
+		for _, data := range configMap.Data {
+			err = json.Unmarshal([]byte(data), &report)
+		}
+		return report, err
+	}
+	done := make(chan error)
+	go func() {
+		done <- evictionHandler.EvictPods(nil, 5*time.Second, nil)
+	}()
+	var report DrainReport
+	if err := wait.Poll(10*time.Millisecond, 3*time.Second, func() (bool, error) {
+		var err error
+		report, err = getReport()
+		return err == nil && len(report.Pods) == 1 && report.Pods[0].Issued != nil, nil
+	}); err != nil {
+		t.Fatalf("expected the report to be persisted once the eviction was issued, got %+v", report)
+	}
+	if !report.InProgress || report.Pods[0].Tier == "" {
+		t.Errorf("expected a report in progress of the planned tier, got %+v", report)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	report, err := getReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.InProgress || report.Finished.IsZero() || len(report.Pods) != 1 || report.Pods[0].FinishedInTime {
+		t.Errorf("expected the report to be completed, got %+v", report)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+// ShutdownBudgetAnnotation declares how many seconds a pod needs to shut down, including its pre-eviction hook.
+// Pods without it are given their `terminationGracePeriodSeconds`.
+const ShutdownBudgetAnnotation = "node-termination-handler/shutdown-budget-seconds"
+
+// deletionBatch is a group of pods whose deletion is issued at the same time.
+type deletionBatch struct {
+	at   time.Time
+	pods []v1.Pod
+}
+
+// planDeletions returns when the deletion of `pods` must be issued for them to be gone by `deadline`, in order.
+// All pods are deleted at `start` unless just-in-time evictions are enabled, in which case pods keep running until
+// their shutdown budget, bounded by `gracePeriod`, and the safety margin are all that is left before `deadline`.
+// Deletions are never issued before `start`.
+func (p *podEvictionHandler) planDeletions(pods []v1.Pod, gracePeriod int64, start, deadline time.Time) []deletionBatch {
+	if !p.justInTime {
+		return []deletionBatch{{at: start, pods: pods}}
+	}
+	byBudget := map[int64][]v1.Pod{}
+	for _, pod := range pods {
+		budget := shutdownBudget(pod)
+		if budget > gracePeriod {
+			budget = gracePeriod
+		}
+		byBudget[budget] = append(byBudget[budget], pod)
+	}
+	var batches []deletionBatch
+	for budget, pods := range byBudget {
+		at := deadline.Add(-p.safetyMargin - time.Duration(budget)*time.Second)
+		if at.Before(start) {
+			at = start
+		}
+		batches = append(batches, deletionBatch{at: at, pods: pods})
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].at.Before(batches[j].at) })
+	return batches
+}
+
+// shutdownBudget returns the number of seconds `pod` needs to shut down.
+func shutdownBudget(pod v1.Pod) int64 {
+	if value, exists := pod.Annotations[ShutdownBudgetAnnotation]; exists {
+		budget, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && budget >= 0 {
+			return budget
+		}
+		glog.V(2).Infof("Ignoring invalid shutdown budget %q of pod %q in namespace %q", value, pod.Name, pod.Namespace)
+	}
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		return *pod.Spec.TerminationGracePeriodSeconds
+	}
+	return v1.DefaultTerminationGracePeriodSeconds
+}
+
+// deletionScheduler holds deletions until they are due. Deletions that are not due yet are dropped once `stopCh` is closed.
+type deletionScheduler struct {
+	stopCh <-chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newDeletionScheduler(stopCh <-chan struct{}) *deletionScheduler {
+	return &deletionScheduler{stopCh: stopCh}
+}
+
+// schedule invokes `fn` at `at` in its own goroutine, unless the scheduler is stopped first.
+func (s *deletionScheduler) schedule(at time.Time, fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		timer := time.NewTimer(time.Until(at))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-s.stopCh:
+			return
+		}
+		// Prefer stopping when both are ready at once.
+		if isStopped(s.stopCh) {
+			return
+		}
+		fn()
+	}()
+}
+
+// wait blocks until all scheduled deletions have completed or have been dropped.
+func (s *deletionScheduler) wait() {
+	s.wg.Wait()
+}
+
+// isStopped returns true if `stopCh` is closed.
+func isStopped(stopCh <-chan struct{}) bool {
+	select {
+	case <-stopCh:
+		return true
+	default:
+		return false
+	}
+}
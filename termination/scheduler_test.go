@@ -0,0 +1,152 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func TestPlanDeletions(t *testing.T) {
+	pods := []v1.Pod{
+		makePod(pod{name: "annotated", namespace: "default", nodeName: "localhost", annotations: map[string]string{ShutdownBudgetAnnotation: "120"}, terminationGracePeriod: int64Ptr(10)}),
+		makePod(pod{name: "graceful", namespace: "default", nodeName: "localhost", terminationGracePeriod: int64Ptr(300)}),
+		makePod(pod{name: "default", namespace: "default", nodeName: "localhost"}),
+		makePod(pod{name: "invalid", namespace: "default", nodeName: "localhost", annotations: map[string]string{ShutdownBudgetAnnotation: "soon"}, terminationGracePeriod: int64Ptr(30)}),
+		makePod(pod{name: "slow", namespace: "default", nodeName: "localhost", annotations: map[string]string{ShutdownBudgetAnnotation: "7200"}}),
+	}
+	evictionHandler := &podEvictionHandler{justInTime: true, safetyMargin: 30 * time.Second}
+	deadline := time.Now().Add(time.Hour)
+	batches := evictionHandler.planDeletions(pods, 1800, time.Now(), deadline)
+	expected := []struct {
+		pods []string
+		// before is the time left before the deadline when the pods are deleted.
+		before time.Duration
+	}{
+		{pods: []string{"slow"}, before: 1830 * time.Second},
+		{pods: []string{"graceful"}, before: 330 * time.Second},
+		{pods: []string{"annotated"}, before: 150 * time.Second},
+		{pods: []string{"default", "invalid"}, before: 60 * time.Second},
+	}
+	if len(batches) != len(expected) {
+		t.Fatalf("expected %d batches, got %d: %+v", len(expected), len(batches), batches)
+	}
+	for i, batch := range batches {
+		var names []string
+		for _, pod := range batch.pods {
+			names = append(names, pod.Name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, expected[i].pods) {
+			t.Errorf("batch %d: expected pods %v, got %v", i, expected[i].pods, names)
+		}
+		if before := deadline.Sub(batch.at); before != expected[i].before {
+			t.Errorf("batch %d: expected pods to be deleted %v before the deadline, got %v", i, expected[i].before, before)
+		}
+	}
+
+	// Pods whose budget exceeds the time left are deleted right away.
+	start := time.Now()
+	batches = evictionHandler.planDeletions(pods, 1800, start, start.Add(time.Minute))
+	for _, batch := range batches[:3] {
+		if !batch.at.Equal(start) {
+			t.Errorf("expected pods %v to be deleted right away, got %v", batch.pods, batch.at)
+		}
+	}
+
+	evictionHandler.justInTime = false
+	if batches := evictionHandler.planDeletions(pods, 1800, time.Now(), deadline); len(batches) != 1 || len(batches[0].pods) != len(pods) {
+		t.Errorf("expected all pods to be deleted at once, got %+v", batches)
+	}
+}
+
+func TestJustInTimeEvictionsAreCancelled(t *testing.T) {
+	podList := v1.PodList{Items: []v1.Pod{
+		makePod(pod{name: "quick", namespace: "default", nodeName: "localhost", annotations: map[string]string{ShutdownBudgetAnnotation: "0"}}),
+		makePod(pod{name: "slow", namespace: "default", nodeName: "localhost", annotations: map[string]string{ShutdownBudgetAnnotation: "60"}}),
+	}}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&podList)
+	evictionHandler := &podEvictionHandler{
+		client:                 kubeClientset.CoreV1(),
+		policyClient:           newFakePolicyClient(kubeClientset.CoreV1()),
+		node:                   "localhost",
+		recorder:               record.NewFakeRecorder(20),
+		maxConcurrentEvictions: 1,
+		rateLimiter:            flowcontrol.NewFakeAlwaysRateLimiter(),
+		phases:                 defaultEvictionPhases(t),
+		justInTime:             true,
+	}
+	stopCh := make(chan struct{})
+	// The slow pod is deleted right away while the quick one keeps running until the stop.
+	time.AfterFunc(time.Second, func() { close(stopCh) })
+	start := time.Now()
+	if err := evictionHandler.EvictPods(nil, 12*time.Second, stopCh); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected evictions to stop once cancelled, took %v", elapsed)
+	}
+	pods, err := kubeClientset.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 1 || pods.Items[0].Name != "quick" {
+		t.Errorf("expected only the quick pod to remain, got %v", pods.Items)
+	}
+}
+
+func TestJustInTimeEvictionsWaitUntilTheEndOfTheTier(t *testing.T) {
+	podList := v1.PodList{Items: []v1.Pod{makePod(pod{name: "stuck", namespace: "default", nodeName: "localhost", annotations: map[string]string{ShutdownBudgetAnnotation: "1"}})}}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&podList)
+	policyClient := newFakePolicyClient(kubeClientset.CoreV1())
+	policyClient.evictions.stuck["stuck"] = true
+	tracker, _, err := newPodTracker(kubeClientset.CoreV1(), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.stop()
+	start := time.Now()
+	evictionHandler := &podEvictionHandler{
+		client:                 kubeClientset.CoreV1(),
+		policyClient:           policyClient,
+		node:                   "localhost",
+		recorder:               record.NewFakeRecorder(20),
+		maxConcurrentEvictions: 1,
+		rateLimiter:            flowcontrol.NewFakeAlwaysRateLimiter(),
+		justInTime:             true,
+		safetyMargin:           time.Second,
+		tracker:                tracker,
+		report:                 newDrainReporter("localhost", start, start.Add(3*time.Second)),
+	}
+	// The pod is deleted a couple of seconds before the deadline, and not waited for past the end of the tier.
+	remaining, err := evictionHandler.deletePods(podList.Items, nil, 3600, start.Add(3*time.Second), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the stuck pod not to be waited for past the end of the tier, took %v", elapsed)
+	}
+	if len(remaining) != 1 {
+		t.Errorf("expected the stuck pod to remain, got %v", remaining)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	client "k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// shadowPlanReason is recorded on nodes and pods in shadow mode, describing what would have been done to them.
+const shadowPlanReason = "NodeTerminationShadowPlan"
+
+// shadowTaintHandler records the changes a nodeTaintHandler would make to the node without making them.
+type shadowTaintHandler struct {
+	taint                   *v1.Taint
+	advanceNoticeTaint      *v1.Taint
+	annotation              string
+	liveMigrationAnnotation string
+	node                    string
+	client                  corev1.CoreV1Interface
+	recorder                record.EventRecorder
+}
+
+// NewShadowNodeTaintHandler returns a NodeTaintHandler that only reads the node, and logs and records events about
+// the taints and annotations that would be applied to it.
+func NewShadowNodeTaintHandler(taint, advanceNoticeTaint *v1.Taint, annotation, liveMigrationAnnotation, node string, client *client.Clientset, recorder record.EventRecorder) NodeTaintHandler {
+	return &shadowTaintHandler{
+		taint:                   taint,
+		advanceNoticeTaint:      advanceNoticeTaint,
+		annotation:              annotation,
+		liveMigrationAnnotation: liveMigrationAnnotation,
+		node:                    node,
+		client:                  client.CoreV1(),
+		recorder:                recorder,
+	}
+}
+
+func (s *shadowTaintHandler) ApplyTaint() error {
+	node, err := s.client.Nodes().Get(s.node, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if s.annotation != "" {
+		if node.Annotations[s.annotation] != "true" {
+			s.record("would set annotation %s=true on the node", s.annotation)
+		}
+	} else if _, updated := addOrUpdateTaint(node, s.taint); updated {
+		s.record("would taint the node with %s", s.taint.ToString())
+	}
+	return nil
+}
+
+func (s *shadowTaintHandler) ApplyAdvanceNoticeTaint(window MaintenanceWindow) error {
+	node, err := s.client.Nodes().Get(s.node, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if s.annotation != "" {
+		if node.Annotations[s.annotation] == "true" {
+			s.record("would set annotation %s=false on the node", s.annotation)
+		}
+	} else if _, updated := removeTaint(node, s.taint); updated {
+		s.record("would remove taint %s from the node", s.taint.ToString())
+	}
+	if s.advanceNoticeTaint != nil {
+		if _, updated := addOrUpdateTaint(node, s.advanceNoticeTaint); updated {
+			s.record("would taint the node with %s ahead of maintenance scheduled between %v and %v", s.advanceNoticeTaint.ToString(), window.Start, window.End)
+		}
+	}
+	return nil
+}
+
+func (s *shadowTaintHandler) RemoveTaint() error {
+	node, err := s.client.Nodes().Get(s.node, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if s.annotation != "" {
+		if node.Annotations[s.annotation] == "true" {
+			s.record("would set annotation %s=false on the node", s.annotation)
+		}
+	} else if _, updated := removeTaint(node, s.taint); updated {
+		s.record("would remove taint %s from the node", s.taint.ToString())
+	}
+	if s.advanceNoticeTaint != nil {
+		if _, updated := removeTaint(node, s.advanceNoticeTaint); updated {
+			s.record("would remove taint %s from the node", s.advanceNoticeTaint.ToString())
+		}
+	}
+	return nil
+}
+
+func (s *shadowTaintHandler) MarkLiveMigration(inProgress bool) error {
+	if s.liveMigrationAnnotation == "" {
+		return nil
+	}
+	node, err := s.client.Nodes().Get(s.node, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if _, annotated := node.Annotations[s.liveMigrationAnnotation]; inProgress != annotated {
+		if inProgress {
+			s.record("would set annotation %s=true on the node", s.liveMigrationAnnotation)
+		} else {
+			s.record("would remove annotation %s from the node", s.liveMigrationAnnotation)
+		}
+	}
+	return nil
+}
+
+// record logs the change described by `format` and records it in an event on the node.
+func (s *shadowTaintHandler) record(format string, args ...interface{}) {
+	recordShadowNodePlan(s.recorder, s.node, format, args...)
+}
+
+func recordShadowNodePlan(recorder record.EventRecorder, node, format string, args ...interface{}) {
+	glog.V(2).Infof("Shadow mode: "+format, args...)
+	ref := &v1.ObjectReference{Kind: "Node", Name: node, UID: types.UID(node)}
+	recorder.Eventf(ref, v1.EventTypeNormal, shadowPlanReason, "Shadow mode: "+format, args...)
+}
+
+// shadowPodEvictionHandler plans the evictions a podEvictionHandler would make without evicting any pod.
+// It does not implement VolumeDetachWaiter, since no volume gets detached.
+type shadowPodEvictionHandler struct {
+	evictions *podEvictionHandler
+}
+
+// NewShadowPodEvictionHandler returns a PodEvictionHandler that only reads pods, and logs, records events about and
+// reports the tier, time and grace period every pod would be evicted with. Pre-eviction hooks are not run.
+func NewShadowPodEvictionHandler(node string, client *client.Clientset, recorder record.EventRecorder, options PodEvictionOptions) (PodEvictionHandler, error) {
+	evictions, err := NewPodEvictionHandler(node, client, recorder, options)
+	if err != nil {
+		return nil, err
+	}
+	return &shadowPodEvictionHandler{evictions: evictions.(*podEvictionHandler)}, nil
+}
+
+// EvictPods publishes the eviction plan as a drain report and returns right away.
+func (s *shadowPodEvictionHandler) EvictPods(exclusions *PodExclusions, timeout time.Duration, stopCh <-chan struct{}) error {
+	p := s.evictions
+	start := time.Now()
+	plan := newDrainReporter(p.node, start, start.Add(timeout))
+	pods, err := p.client.Pods(metav1.NamespaceAll).List(metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("spec.nodeName", p.node).String()})
+	if err != nil {
+		glog.V(2).Infof("Failed to list pods - %v", err)
+		return err
+	}
+	skipped, tiers, _ := p.planEvictions(pods.Items, exclusions, timeout)
+	for _, skip := range skipped {
+		glog.V(2).Infof("Shadow mode: would not evict pod %q in namespace %q: %s", skip.pod.Name, skip.pod.Namespace, skip.reason)
+		plan.skipped(skip.pod, skip.reason)
+	}
+	tierDeadline := start
+	for _, tier := range tiers {
+		// Tiers are assumed to start once the pods of the previous tier used up their whole grace period.
+		tierStart := tierDeadline
+		tierDeadline = tierDeadline.Add(tier.gracePeriod)
+		plan.assigned(tier.pods, tier.description)
+		gracePeriod := int64(tier.gracePeriod.Seconds())
+		for _, batch := range p.planDeletions(tier.pods, gracePeriod, tierStart, tierDeadline) {
+			for _, pod := range batch.pods {
+				// Pre-eviction hooks are assumed to complete right away.
+				podGracePeriod := requestedGracePeriod(pod, gracePeriodAt(gracePeriod, batch.at, p.evictionEnd(tierDeadline)))
+				glog.V(2).Infof("Shadow mode: would evict pod %q in namespace %q at %v within grace period %d seconds among %s", pod.Name, pod.Namespace, batch.at, podGracePeriod, tier.description)
+				p.recorder.Eventf(&pod, v1.EventTypeNormal, shadowPlanReason, "Node %q is about to be terminated. Shadow mode: pod would be evicted in %v within a grace period of %d seconds.", p.node, batch.at.Sub(start).Round(time.Second), podGracePeriod)
+				plan.planned(pod, batch.at, podGracePeriod)
+			}
+		}
+	}
+	report := plan.complete(false, nil)
+	report.Shadow = true
+	p.publishReport(report)
+	return nil
+}
+
+// shadowRebooter records that the node would be rebooted without rebooting it.
+type shadowRebooter struct {
+	node     string
+	recorder record.EventRecorder
+}
+
+// NewShadowNodeRebooter returns a NodeRebooter that logs and records an event instead of rebooting the node.
+func NewShadowNodeRebooter(node string, recorder record.EventRecorder) NodeRebooter {
+	return &shadowRebooter{node: node, recorder: recorder}
+}
+
+func (s *shadowRebooter) Reboot() error {
+	recordShadowNodePlan(s.recorder, s.node, "would reboot the node")
+	return nil
+}
+
+// shadowTerminationSource hides the NodeTerminationAcknowledger implementation of the source it wraps, such that
+// pending terminations are not acknowledged to the platform in shadow mode.
+type shadowTerminationSource struct {
+	NodeTerminationSource
+}
+
+// NewShadowTerminationSource returns a NodeTerminationSource reporting the terminations of `source` without them
+// ever being acknowledged.
+func NewShadowTerminationSource(source NodeTerminationSource) NodeTerminationSource {
+	return shadowTerminationSource{source}
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// mutations returns the actions of `kubeClientset` other than reads.
+func mutations(kubeClientset *fakekubeclientset.Clientset) []core.Action {
+	var actions []core.Action
+	for _, action := range kubeClientset.Actions() {
+		switch action.GetVerb() {
+		case "get", "list", "watch":
+		default:
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+func shadowEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.Contains(event, shadowPlanReason) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestShadowEvictionsLeavePodsRunning(t *testing.T) {
+	systemPod := makePod(pod{name: "dns", namespace: "kube-system", nodeName: "localhost"})
+	regularPod := makePod(pod{name: "web", namespace: "default", nodeName: "localhost", terminationGracePeriod: int64Ptr(10)})
+	succeededPod := makePod(pod{name: "job", namespace: "default", nodeName: "localhost"})
+	succeededPod.Status.Phase = v1.PodSucceeded
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&v1.PodList{Items: []v1.Pod{systemPod, regularPod, succeededPod}})
+	recorder := record.NewFakeRecorder(20)
+	evictionHandler := &shadowPodEvictionHandler{
+		evictions: &podEvictionHandler{
+			client:                 kubeClientset.CoreV1(),
+			policyClient:           newFakePolicyClient(kubeClientset.CoreV1()),
+			node:                   "localhost",
+			recorder:               recorder,
+			maxConcurrentEvictions: 1,
+			rateLimiter:            flowcontrol.NewFakeAlwaysRateLimiter(),
+			phases:                 defaultEvictionPhases(t),
+		},
+	}
+	if _, ok := PodEvictionHandler(evictionHandler).(VolumeDetachWaiter); ok {
+		t.Error("expected shadow evictions not to wait for volumes to be detached")
+	}
+	start := time.Now()
+	if err := evictionHandler.EvictPods(nil, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the plan to be published right away, took %v", elapsed)
+	}
+	if actions := mutations(kubeClientset); len(actions) != 0 {
+		t.Errorf("expected no changes, got %v", actions)
+	}
+	// Evicted pods and the report summary are recorded.
+	if events := shadowEvents(recorder); len(events) != 3 {
+		t.Errorf("expected 3 shadow events, got %v", events)
+	}
+}
+
+func TestShadowEvictionsPublishPlan(t *testing.T) {
+	systemPod := makePod(pod{name: "dns", namespace: "kube-system", nodeName: "localhost"})
+	regularPod := makePod(pod{name: "web", namespace: "default", nodeName: "localhost", terminationGracePeriod: int64Ptr(10)})
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&v1.PodList{Items: []v1.Pod{systemPod, regularPod}})
+	evictionHandler := &shadowPodEvictionHandler{
+		evictions: &podEvictionHandler{
+			client:                 kubeClientset.CoreV1(),
+			node:                   "localhost",
+			recorder:               record.NewFakeRecorder(20),
+			maxConcurrentEvictions: 1,
+			phases:                 defaultEvictionPhases(t),
+			reportNamespace:        "kube-system",
+		},
+	}
+	start := time.Now()
+	if err := evictionHandler.EvictPods(nil, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+	configMap, err := kubeClientset.CoreV1().ConfigMaps("kube-system").Get(drainReportConfigMapPrefix+"localhost", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report DrainReport
+	for _, data := range configMap.Data {
+		if err := json.Unmarshal([]byte(data), &report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !report.Shadow || len(report.Pods) != 2 {
+		t.Fatalf("expected a shadow report of 2 pods, got %+v", report)
+	}
+	web, dns := report.Pods[0], report.Pods[1]
+	if web.Name != "web" || web.GracePeriodSeconds == nil || *web.GracePeriodSeconds != 10 || web.Issued == nil {
+		t.Errorf("expected the regular pod to be planned with its termination grace period, got %+v", web)
+	}
+	if dns.Name != "dns" || dns.Issued == nil || dns.Tier == web.Tier {
+		t.Fatalf("expected the system pod to be planned in its own tier, got %+v", dns)
+	}
+	// System pods are evicted once the regular pods are gone.
+	if !dns.Issued.After(start.Add(20 * time.Second)) {
+		t.Errorf("expected the system pod to be evicted after the regular pods, got %v", dns.Issued.Sub(start))
+	}
+}
+
+func TestShadowReportsLeaveOtherReportsAlone(t *testing.T) {
+	staleReports := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      drainReportConfigMapPrefix + "gone",
+			Namespace: "kube-system",
+			Labels:    map[string]string{drainReportLabel: "true"},
+		},
+		Data: map[string]string{time.Now().Add(-30 * 24 * time.Hour).UTC().Format(drainReportKeyFormat): "{}"},
+	}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(staleReports)
+	evictionHandler := &shadowPodEvictionHandler{
+		evictions: &podEvictionHandler{
+			client:          kubeClientset.CoreV1(),
+			node:            "localhost",
+			recorder:        record.NewFakeRecorder(20),
+			phases:          defaultEvictionPhases(t),
+			reportNamespace: "kube-system",
+		},
+	}
+	if err := evictionHandler.EvictPods(nil, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubeClientset.CoreV1().ConfigMaps("kube-system").Get(staleReports.Name, metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the reports of other nodes to be kept in shadow mode, got %v", err)
+	}
+}
+
+func TestShadowTaintHandlerLeavesNodeUntouched(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "localhost"}}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(node)
+	recorder := record.NewFakeRecorder(20)
+	taintHandler := &shadowTaintHandler{
+		taint:                   &v1.Taint{Key: "cloud.google.com/impending-node-termination", Effect: v1.TaintEffectNoSchedule},
+		liveMigrationAnnotation: "cloud.google.com/live-migration-in-progress",
+		node:                    "localhost",
+		client:                  kubeClientset.CoreV1(),
+		recorder:                recorder,
+	}
+	if err := taintHandler.ApplyTaint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := taintHandler.MarkLiveMigration(true); err != nil {
+		t.Fatal(err)
+	}
+	// The taint was never applied, so there is nothing to remove.
+	if err := taintHandler.RemoveTaint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewShadowNodeRebooter("localhost", recorder).Reboot(); err != nil {
+		t.Fatal(err)
+	}
+	if actions := mutations(kubeClientset); len(actions) != 0 {
+		t.Errorf("expected no changes, got %v", actions)
+	}
+	events := shadowEvents(recorder)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 shadow events, got %v", events)
+	}
+	for i, expected := range []string{"would taint the node with cloud.google.com/impending-node-termination:NoSchedule", "would set annotation cloud.google.com/live-migration-in-progress=true", "would reboot the node"} {
+		if !strings.Contains(events[i], expected) {
+			t.Errorf("expected event %q to mention %q", events[i], expected)
+		}
+	}
+}
+
+type fakeAcknowledgingSource struct {
+	NodeTerminationSource
+}
+
+func (fakeAcknowledgingSource) AcknowledgeTermination(state NodeTerminationState) error {
+	return nil
+}
+
+func TestShadowTerminationSourceIsNotAcknowledged(t *testing.T) {
+	if _, ok := NewShadowTerminationSource(fakeAcknowledgingSource{}).(NodeTerminationAcknowledger); ok {
+		t.Error("expected shadow terminations not to be acknowledged")
+	}
+}
@@ -16,35 +16,51 @@ package termination
 
 import (
 	"bytes"
-	"cloud.google.com/go/compute/metadata"
 	"encoding/json"
+	"errors"
 	"net/http"
-	"os"
 )
 
 const (
 	machineTypeSuffix = "instance/machine-type"
 )
 
-func sendSlack() error {
-	url := os.Getenv("SLACK_WEBHOOK_URL")
-	if url == "" {
-		return nil
+const (
+	terminationTitle         = ":warning: Node Termination"
+	upcomingMaintenanceTitle = ":calendar: Upcoming Node Maintenance"
+)
+
+// slackNotifier posts notifications describing the node to a Slack incoming webhook.
+type slackNotifier struct {
+	url string
+	// metadataClient is used to describe the node. It is nil outside of GCE.
+	metadataClient MetadataClient
+}
+
+// NewSlackNotifier returns a Notifier posting to the Slack incoming webhook `url`.
+func NewSlackNotifier(url string, metadataClient MetadataClient) Notifier {
+	return &slackNotifier{url: url, metadataClient: metadataClient}
+}
+
+func (s *slackNotifier) Notify(title string) error {
+	metadataClient := s.metadataClient
+	if metadataClient == nil {
+		return errors.New("slack notifications require access to GCE metadata")
 	}
 
-	instanceName, err := metadata.InstanceName()
+	instanceName, err := metadataClient.InstanceName()
 	if err != nil {
 		return err
 	}
-	zone, err := metadata.Zone()
+	zone, err := metadataClient.Zone()
 	if err != nil {
 		return err
 	}
-	projectID, err := metadata.ProjectID()
+	projectID, err := metadataClient.ProjectID()
 	if err != nil {
 		return err
 	}
-	machineType, err := metadata.Get(machineTypeSuffix)
+	machineType, err := metadataClient.Get(machineTypeSuffix)
 	if err != nil {
 		return err
 	}
@@ -53,7 +69,7 @@ func sendSlack() error {
 		"attachments": []map[string]interface{}{
 			{
 				"color": "warning",
-				"title": ":warning: Node Termination",
+				"title": title,
 				"fields": []map[string]interface{}{
 					{
 						"title": "InstanceName",
@@ -85,7 +101,7 @@ func sendSlack() error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(b))
+	req, err := http.NewRequest("POST", s.url, bytes.NewBuffer(b))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,133 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const (
+	// forceDeletedReason is recorded on pods that are deleted with a grace period of 0 because they outlived their eviction.
+	forceDeletedReason = "NodeTerminationForceDeleted"
+	// finalizersRemovedReason is recorded on pods whose finalizers are removed for them to be deleted.
+	finalizersRemovedReason = "NodeTerminationFinalizersRemoved"
+	// finalizerUpdateAttempts bounds the number of attempts to remove finalizers from pods being updated concurrently.
+	finalizerUpdateAttempts = 3
+)
+
+// forceDeleteStragglers waits for `pods` to be gone until `forceDeleteLeadTime` before `deadline`. The pods that still
+// exist by then are deleted with a grace period of 0, and the finalizers matching `finalizerAllowlist` are removed from them.
+func (p *podEvictionHandler) forceDeleteStragglers(pods []v1.Pod, deadline time.Time, stopCh <-chan struct{}) error {
+	remaining, _ := p.waitForPodsNotFound(pods, time.Until(deadline.Add(-p.forceDeleteLeadTime)), stopCh)
+	if isStopped(stopCh) {
+		return nil
+	}
+	var errs []error
+	for _, pod := range remaining {
+		if err := p.forceDeleteStraggler(pod); err != nil {
+			glog.V(2).Infof("Failed to force delete pod %q in namespace %q - %v", pod.Name, pod.Namespace, err)
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// forceDeleteStraggler deletes `pod` with a grace period of 0 and removes its allowed finalizers.
+func (p *podEvictionHandler) forceDeleteStraggler(pod v1.Pod) error {
+	glog.V(2).Infof("Pod %q in namespace %q outlived its eviction. Deleting it immediately", pod.Name, pod.Namespace)
+	p.recorder.Eventf(&pod, v1.EventTypeWarning, forceDeletedReason, "Node %q is about to be terminated. Pod is still running, deleting it immediately.", p.node)
+	p.report.forced(pod, "outlived its eviction and deleted with a grace period of 0")
+	var gracePeriod int64
+	p.rateLimiter.Accept()
+	if err := p.client.Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod}); err != nil {
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if len(p.finalizerAllowlist) == 0 {
+		return nil
+	}
+	return p.removeFinalizers(pod)
+}
+
+// removeFinalizers removes the finalizers of `pod` that match any of the glob patterns in `finalizerAllowlist`.
+func (p *podEvictionHandler) removeFinalizers(pod v1.Pod) error {
+	var err error
+	for i := 0; i < finalizerUpdateAttempts; i++ {
+		var current *v1.Pod
+		p.rateLimiter.Accept()
+		current, err = p.client.Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var kept, removed []string
+		for _, finalizer := range current.Finalizers {
+			if p.allowsRemoving(finalizer) {
+				removed = append(removed, finalizer)
+			} else {
+				kept = append(kept, finalizer)
+			}
+		}
+		if len(removed) == 0 {
+			return nil
+		}
+		current.Finalizers = kept
+		p.rateLimiter.Accept()
+		_, err = p.client.Pods(pod.Namespace).Update(current)
+		if err == nil || apierrs.IsNotFound(err) {
+			glog.V(2).Infof("Removed finalizers %v from pod %q in namespace %q", removed, pod.Name, pod.Namespace)
+			p.recorder.Eventf(&pod, v1.EventTypeWarning, finalizersRemovedReason, "Node %q is about to be terminated. Removed finalizers %s from pod.", p.node, strings.Join(removed, ", "))
+			p.report.forced(pod, "removed finalizers "+strings.Join(removed, ", "))
+			return nil
+		}
+		if !apierrs.IsConflict(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (p *podEvictionHandler) allowsRemoving(finalizer string) bool {
+	for _, pattern := range p.finalizerAllowlist {
+		if matched, _ := path.Match(pattern, finalizer); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateFinalizerAllowlist checks that `patterns` are valid glob patterns.
+func ValidateFinalizerAllowlist(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid finalizer pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func TestForceDeleteStragglers(t *testing.T) {
+	stuck := makePod(pod{name: "stuck", namespace: "default", nodeName: "localhost"})
+	stuck.Finalizers = []string{"example.com/backup", "other.io/protect"}
+	gone := makePod(pod{name: "gone", namespace: "default", nodeName: "localhost"})
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&stuck)
+	// Deleting the stuck pod has no effect, as if its kubelet was unresponsive.
+	var deletions int
+	kubeClientset.PrependReactor("delete", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		deletions++
+		return true, nil, nil
+	})
+	tracker, _, err := newPodTracker(kubeClientset.CoreV1(), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.stop()
+	recorder := record.NewFakeRecorder(20)
+	evictionHandler := &podEvictionHandler{
+		tracker:             tracker,
+		client:              kubeClientset.CoreV1(),
+		node:                "localhost",
+		recorder:            recorder,
+		rateLimiter:         flowcontrol.NewFakeAlwaysRateLimiter(),
+		forceDeleteLeadTime: 10 * time.Second,
+		finalizerAllowlist:  []string{"example.com/*"},
+	}
+	if err := evictionHandler.forceDeleteStragglers([]v1.Pod{stuck, gone}, time.Now().Add(11*time.Second), nil); err != nil {
+		t.Fatal(err)
+	}
+	if deletions != 1 {
+		t.Fatalf("expected only the stuck pod to be deleted, got %d deletions", deletions)
+	}
+	updated, err := kubeClientset.CoreV1().Pods("default").Get("stuck", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"other.io/protect"}; !reflect.DeepEqual(updated.Finalizers, expected) {
+		t.Errorf("expected finalizers %v to be kept, got %v", expected, updated.Finalizers)
+	}
+	var reasons []string
+	for len(recorder.Events) > 0 {
+		event := <-recorder.Events
+		for _, reason := range []string{forceDeletedReason, finalizersRemovedReason} {
+			if strings.Contains(event, reason) {
+				reasons = append(reasons, reason)
+			}
+		}
+	}
+	if expected := []string{forceDeletedReason, finalizersRemovedReason}; !reflect.DeepEqual(reasons, expected) {
+		t.Errorf("expected events %v, got %v", expected, reasons)
+	}
+}
+
+func TestValidateFinalizerAllowlist(t *testing.T) {
+	if err := ValidateFinalizerAllowlist([]string{"example.com/*", "kubernetes.io/pvc-protection"}); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateFinalizerAllowlist([]string{"example.com/[backup"}); err == nil {
+		t.Error("expected malformed pattern to be rejected")
+	}
+}
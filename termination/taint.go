@@ -24,25 +24,32 @@ import (
 )
 
 type nodeTaintHandler struct {
-	taint      *v1.Taint
-	annotation string
-	node       string
-	client     *client.Clientset
-	recorder   record.EventRecorder
+	taint                   *v1.Taint
+	advanceNoticeTaint      *v1.Taint
+	annotation              string
+	liveMigrationAnnotation string
+	node                    string
+	client                  *client.Clientset
+	recorder                record.EventRecorder
 }
 
 const (
-	taintReason   = "ImpendingNodeTermination"
-	untaintReason = "NoImpendingNodeTermination"
+	taintReason               = "ImpendingNodeTermination"
+	untaintReason             = "NoImpendingNodeTermination"
+	upcomingMaintenanceReason = "UpcomingNodeMaintenance"
+	liveMigrationReason       = "NodeLiveMigration"
+	liveMigrationDoneReason   = "NodeLiveMigrationCompleted"
 )
 
-func NewNodeTaintHandler(taint *v1.Taint, annotation, node string, client *client.Clientset, recorder record.EventRecorder) NodeTaintHandler {
+func NewNodeTaintHandler(taint, advanceNoticeTaint *v1.Taint, annotation, liveMigrationAnnotation, node string, client *client.Clientset, recorder record.EventRecorder) NodeTaintHandler {
 	return &nodeTaintHandler{
-		taint:      taint,
-		annotation: annotation,
-		node:       node,
-		client:     client,
-		recorder:   recorder,
+		taint:                   taint,
+		advanceNoticeTaint:      advanceNoticeTaint,
+		annotation:              annotation,
+		liveMigrationAnnotation: liveMigrationAnnotation,
+		node:                    node,
+		client:                  client,
+		recorder:                recorder,
 	}
 }
 
@@ -75,6 +82,37 @@ func (n *nodeTaintHandler) ApplyTaint() error {
 	return nil
 }
 
+func (n *nodeTaintHandler) ApplyAdvanceNoticeTaint(window MaintenanceWindow) error {
+	node, err := n.client.CoreV1().Nodes().Get(n.node, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	var updated bool
+	// The termination might have been cancelled while the maintenance is still scheduled.
+	if n.annotation != "" {
+		if node.Annotations[n.annotation] == "true" {
+			node.Annotations[n.annotation] = "false"
+			updated = true
+		}
+	} else {
+		node, updated = removeTaint(node, n.taint)
+	}
+	if n.advanceNoticeTaint != nil {
+		var added bool
+		node, added = addOrUpdateTaint(node, n.advanceNoticeTaint)
+		updated = updated || added
+		glog.V(4).Infof("Node %q taints after adding advance notice taint; updated %v: %v", n.node, updated, node.Spec.Taints)
+	}
+	if updated {
+		if _, err = n.client.CoreV1().Nodes().Update(node); err != nil {
+			glog.V(2).Infof("Failed to update node object: %v", err)
+			return err
+		}
+	}
+	n.recorder.Eventf(node, v1.EventTypeWarning, upcomingMaintenanceReason, "Node maintenance is scheduled between %v and %v. Workloads should prepare for the node to be terminated", window.Start, window.End)
+	return nil
+}
+
 func (n *nodeTaintHandler) RemoveTaint() error {
 	node, err := n.client.CoreV1().Nodes().Get(n.node, metav1.GetOptions{})
 	if err != nil {
@@ -88,6 +126,11 @@ func (n *nodeTaintHandler) RemoveTaint() error {
 	} else {
 		node, updated = removeTaint(node, n.taint)
 	}
+	if n.advanceNoticeTaint != nil {
+		var removed bool
+		node, removed = removeTaint(node, n.advanceNoticeTaint)
+		updated = updated || removed
+	}
 	if updated {
 		if _, err = n.client.CoreV1().Nodes().Update(node); err != nil {
 			return err
@@ -98,6 +141,39 @@ func (n *nodeTaintHandler) RemoveTaint() error {
 	return nil
 }
 
+func (n *nodeTaintHandler) MarkLiveMigration(inProgress bool) error {
+	node, err := n.client.CoreV1().Nodes().Get(n.node, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if n.liveMigrationAnnotation != "" {
+		_, annotated := node.Annotations[n.liveMigrationAnnotation]
+		if inProgress != annotated {
+			if inProgress {
+				if node.Annotations == nil {
+					node.Annotations = map[string]string{}
+				}
+				node.Annotations[n.liveMigrationAnnotation] = "true"
+			} else {
+				delete(node.Annotations, n.liveMigrationAnnotation)
+			}
+			if node, err = n.client.CoreV1().Nodes().Update(node); err != nil {
+				glog.V(2).Infof("Failed to update node object: %v", err)
+				return err
+			}
+		} else if !inProgress {
+			// There is no live migration to report the end of, e.g. when clearing annotations on startup.
+			return nil
+		}
+	}
+	if inProgress {
+		n.recorder.Event(node, v1.EventTypeNormal, liveMigrationReason, "Node is being live migrated to another host. Pods are not evicted")
+	} else {
+		n.recorder.Event(node, v1.EventTypeNormal, liveMigrationDoneReason, "Node live migration completed")
+	}
+	return nil
+}
+
 // AddOrUpdateTaint tries to add a taint to taint list. Returns a new copy of updated Node and true if something was updated
 // false otherwise.
 func addOrUpdateTaint(node *v1.Node, taint *v1.Taint) (*v1.Node, bool) {
@@ -0,0 +1,244 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// GracePeriodFixed gives the pods of a phase the grace period specified by the phase.
+	GracePeriodFixed = "Fixed"
+	// GracePeriodRemaining gives the pods of a phase all the time that is not reserved by other phases.
+	GracePeriodRemaining = "Remaining"
+	// safeToEvictAnnotation set to "false" marks pods that are evicted in the last phase.
+	safeToEvictAnnotation = "cluster-autoscaler.kubernetes.io/safe-to-evict"
+	// defaultSystemPodGracePeriod is the grace period of system pods when no phases are specified.
+	defaultSystemPodGracePeriod = 30 * time.Second
+)
+
+// ShutdownGracePeriodByPodPriority assigns a grace period to pods whose priority is at least `Priority` and lower than
+// the priority of the next tier. It mirrors the kubelet configuration of the same name.
+type ShutdownGracePeriodByPodPriority struct {
+	Priority                   int32 `json:"priority"`
+	ShutdownGracePeriodSeconds int64 `json:"shutdownGracePeriodSeconds"`
+}
+
+// ValidatePriorityTiers sorts `tiers` by increasing priority and checks that they are well formed.
+func ValidatePriorityTiers(tiers []ShutdownGracePeriodByPodPriority) error {
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Priority < tiers[j].Priority })
+	for i, tier := range tiers {
+		if tier.ShutdownGracePeriodSeconds < 0 {
+			return fmt.Errorf("negative shutdown grace period for priority %d", tier.Priority)
+		}
+		if i > 0 && tiers[i-1].Priority == tier.Priority {
+			return fmt.Errorf("priority %d specified more than once", tier.Priority)
+		}
+	}
+	return nil
+}
+
+// EvictionPhase selects pods that are evicted together. Phases are evicted one after the other.
+type EvictionPhase struct {
+	// Name describes the phase in logs.
+	Name string `json:"name"`
+	// Namespaces restricts the phase to pods in the listed namespaces.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Selector restricts the phase to pods matching the label selector, e.g. `tier=frontend`.
+	Selector string `json:"selector,omitempty"`
+	// GracePeriodStrategy is either `Fixed` (the default) or `Remaining`.
+	GracePeriodStrategy string `json:"gracePeriodStrategy,omitempty"`
+	// GracePeriodSeconds is the grace period of pods in `Fixed` phases.
+	GracePeriodSeconds int64 `json:"gracePeriodSeconds,omitempty"`
+
+	namespaces sets.String
+	selector   labels.Selector
+}
+
+// DefaultEvictionPhases evicts pods in kube-system namespace at the end, with `systemPodGracePeriod`.
+// This is especially helpful in scenarios like reclaiming logs prior to node termination.
+func DefaultEvictionPhases(systemPodGracePeriod time.Duration) []EvictionPhase {
+	return []EvictionPhase{
+		{Name: "regular pods", GracePeriodStrategy: GracePeriodRemaining},
+		{Name: "system pods", Namespaces: []string{systemNamespace}, GracePeriodSeconds: int64(systemPodGracePeriod.Seconds())},
+	}
+}
+
+// ValidateEvictionPhases checks that `phases` are well formed and parses their selectors.
+// Exactly one phase must not restrict pods in any way. It collects all pods not selected by other phases.
+func ValidateEvictionPhases(phases []EvictionPhase) error {
+	var catchAll, remaining int
+	for i := range phases {
+		phase := &phases[i]
+		selector, err := labels.Parse(phase.Selector)
+		if err != nil {
+			return fmt.Errorf("invalid selector of phase %q: %v", phase.Name, err)
+		}
+		phase.selector = selector
+		phase.namespaces = sets.NewString(phase.Namespaces...)
+		if phase.Selector == "" && len(phase.Namespaces) == 0 {
+			catchAll++
+		}
+		switch phase.GracePeriodStrategy {
+		case "":
+			phase.GracePeriodStrategy = GracePeriodFixed
+		case GracePeriodFixed:
+		case GracePeriodRemaining:
+			remaining++
+		default:
+			return fmt.Errorf("invalid grace period strategy %q of phase %q", phase.GracePeriodStrategy, phase.Name)
+		}
+		if phase.GracePeriodSeconds < 0 {
+			return fmt.Errorf("negative grace period for phase %q", phase.Name)
+		}
+	}
+	if catchAll != 1 {
+		return fmt.Errorf("expected exactly one phase without namespaces and selector, found %d", catchAll)
+	}
+	if remaining > 1 {
+		return fmt.Errorf("at most one phase can use the %q grace period strategy, found %d", GracePeriodRemaining, remaining)
+	}
+	return nil
+}
+
+// matches returns true if `pod` is selected by the phase. Phases without any restriction match all pods.
+func (e *EvictionPhase) matches(pod v1.Pod) bool {
+	if e.namespaces.Len() > 0 && !e.namespaces.Has(pod.Namespace) {
+		return false
+	}
+	return e.selector.Matches(labels.Set(pod.Labels))
+}
+
+// evictionTier is a group of pods that are evicted together.
+type evictionTier struct {
+	description string
+	pods        []v1.Pod
+	gracePeriod time.Duration
+	// remaining is set for tiers that are given all the time not reserved by other tiers.
+	remaining bool
+}
+
+// groupPods splits `pods` into the tiers they are evicted in, in order, and fits their grace periods into `timeout`.
+// Tiers without any pods are omitted.
+func (p *podEvictionHandler) groupPods(pods []v1.Pod, timeout time.Duration) []evictionTier {
+	var tiers []evictionTier
+	if len(p.priorityTiers) > 0 {
+		tiers = p.groupPodsByPriority(pods)
+	} else {
+		tiers = p.groupPodsByPhase(pods)
+	}
+	fitGracePeriods(tiers, timeout)
+	return tiers
+}
+
+// groupPodsByPhase assigns pods to the first phase that selects them, or to the phase without restrictions.
+// DaemonSet pods and pods that must not be evicted by the cluster autoscaler are evicted in the last phase.
+func (p *podEvictionHandler) groupPodsByPhase(pods []v1.Pod) []evictionTier {
+	grouped := make([][]v1.Pod, len(p.phases))
+	for _, pod := range pods {
+		i := len(p.phases) - 1
+		if pod.Annotations[safeToEvictAnnotation] != "false" && !isDaemonSetPod(pod) {
+			i = p.phaseOf(pod)
+		}
+		grouped[i] = append(grouped[i], pod)
+	}
+	var tiers []evictionTier
+	for i, phase := range p.phases {
+		if len(grouped[i]) == 0 {
+			continue
+		}
+		tiers = append(tiers, evictionTier{
+			description: phase.Name,
+			pods:        grouped[i],
+			gracePeriod: time.Duration(phase.GracePeriodSeconds) * time.Second,
+			remaining:   phase.GracePeriodStrategy == GracePeriodRemaining,
+		})
+	}
+	return tiers
+}
+
+func (p *podEvictionHandler) phaseOf(pod v1.Pod) int {
+	catchAll := -1
+	for i, phase := range p.phases {
+		if phase.Selector == "" && len(phase.Namespaces) == 0 {
+			catchAll = i
+		} else if phase.matches(pod) {
+			return i
+		}
+	}
+	return catchAll
+}
+
+// groupPodsByPriority evicts pods lowest priority first. Pods with a priority lower than any tier belong to the lowest
+// tier, like they do in kubelet. DaemonSet pods are evicted in the last tier.
+func (p *podEvictionHandler) groupPodsByPriority(pods []v1.Pod) []evictionTier {
+	grouped := make([][]v1.Pod, len(p.priorityTiers))
+	for _, pod := range pods {
+		var priority int32
+		if pod.Spec.Priority != nil {
+			priority = *pod.Spec.Priority
+		}
+		i := sort.Search(len(p.priorityTiers), func(i int) bool { return p.priorityTiers[i].Priority > priority }) - 1
+		if i < 0 {
+			i = 0
+		}
+		if isDaemonSetPod(pod) {
+			i = len(p.priorityTiers) - 1
+		}
+		grouped[i] = append(grouped[i], pod)
+	}
+	var tiers []evictionTier
+	for i, tier := range p.priorityTiers {
+		if len(grouped[i]) == 0 {
+			continue
+		}
+		tiers = append(tiers, evictionTier{
+			description: fmt.Sprintf("pods with priority %d and higher", tier.Priority),
+			pods:        grouped[i],
+			gracePeriod: time.Duration(tier.ShutdownGracePeriodSeconds) * time.Second,
+		})
+	}
+	return tiers
+}
+
+// fitGracePeriods shortens grace periods such that all tiers fit into `timeout`. Pods evicted last are the most
+// important ones to shut down gracefully, so the grace periods of the first tiers are shortened first.
+// The tier with the `Remaining` strategy gets the time left once all other tiers have been accounted for.
+func fitGracePeriods(tiers []evictionTier, timeout time.Duration) {
+	budget := timeout
+	if budget < 0 {
+		budget = 0
+	}
+	for i := len(tiers) - 1; i >= 0; i-- {
+		if tiers[i].remaining {
+			continue
+		}
+		if tiers[i].gracePeriod > budget {
+			tiers[i].gracePeriod = budget
+		}
+		budget -= tiers[i].gracePeriod
+	}
+	for i := range tiers {
+		if tiers[i].remaining {
+			tiers[i].gracePeriod = budget
+		}
+	}
+}
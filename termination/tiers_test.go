@@ -0,0 +1,172 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestGroupPodsByPriority(t *testing.T) {
+	priorityTiers := []ShutdownGracePeriodByPodPriority{
+		{Priority: 2000000000, ShutdownGracePeriodSeconds: 10},
+		{Priority: 0, ShutdownGracePeriodSeconds: 30},
+		{Priority: 1000, ShutdownGracePeriodSeconds: 20},
+	}
+	if err := ValidatePriorityTiers(priorityTiers); err != nil {
+		t.Fatal(err)
+	}
+	pods := []v1.Pod{
+		makePod(pod{name: "critical", namespace: "default", nodeName: "localhost", priority: int32Ptr(2000001000)}),
+		makePod(pod{name: "low", namespace: "default", nodeName: "localhost", priority: int32Ptr(-10)}),
+		makePod(pod{name: "default", namespace: "default", nodeName: "localhost", priority: int32Ptr(0)}),
+		makePod(pod{name: "monitoring", namespace: "default", nodeName: "localhost", priority: int32Ptr(1500)}),
+	}
+	for _, test := range []struct {
+		desc           string
+		timeout        time.Duration
+		expectedPods   [][]string
+		expectedGraces []time.Duration
+	}{
+		{
+			desc:           "enough time",
+			timeout:        time.Hour,
+			expectedPods:   [][]string{{"low", "default"}, {"monitoring"}, {"critical"}},
+			expectedGraces: []time.Duration{30 * time.Second, 20 * time.Second, 10 * time.Second},
+		},
+		{
+			desc:           "lowest priority tiers shortened first",
+			timeout:        25 * time.Second,
+			expectedPods:   [][]string{{"low", "default"}, {"monitoring"}, {"critical"}},
+			expectedGraces: []time.Duration{0, 15 * time.Second, 10 * time.Second},
+		},
+	} {
+		evictionHandler := &podEvictionHandler{priorityTiers: priorityTiers}
+		var actualPods [][]string
+		var actualGraces []time.Duration
+		for _, tier := range evictionHandler.groupPods(pods, test.timeout) {
+			var names []string
+			for _, pod := range tier.pods {
+				names = append(names, pod.Name)
+			}
+			actualPods = append(actualPods, names)
+			actualGraces = append(actualGraces, tier.gracePeriod)
+		}
+		if !reflect.DeepEqual(actualPods, test.expectedPods) || !reflect.DeepEqual(actualGraces, test.expectedGraces) {
+			t.Errorf("%s: expected tiers %v with grace periods %v, got %v with %v", test.desc, test.expectedPods, test.expectedGraces, actualPods, actualGraces)
+		}
+	}
+}
+
+func TestValidatePriorityTiers(t *testing.T) {
+	for _, tiers := range [][]ShutdownGracePeriodByPodPriority{
+		{{Priority: 0, ShutdownGracePeriodSeconds: -1}},
+		{{Priority: 10, ShutdownGracePeriodSeconds: 1}, {Priority: 10, ShutdownGracePeriodSeconds: 2}},
+	} {
+		if err := ValidatePriorityTiers(tiers); err == nil {
+			t.Errorf("expected tiers %+v to be invalid", tiers)
+		}
+	}
+}
+
+func TestGroupPodsByPhase(t *testing.T) {
+	phases := []EvictionPhase{
+		{Name: "batch", Namespaces: []string{"batch"}, GracePeriodSeconds: 10},
+		{Name: "frontend", Selector: "tier=frontend", GracePeriodSeconds: 20},
+		{Name: "everything else", GracePeriodStrategy: GracePeriodRemaining},
+		{Name: "logging", Selector: "app=fluentbit", GracePeriodSeconds: 30},
+	}
+	if err := ValidateEvictionPhases(phases); err != nil {
+		t.Fatal(err)
+	}
+	var pods []v1.Pod
+	for _, p := range []struct {
+		name, namespace string
+		labels          map[string]string
+		annotations     map[string]string
+	}{
+		{name: "fluentbit", namespace: "kube-system", labels: map[string]string{"app": "fluentbit"}},
+		{name: "web", namespace: "default", labels: map[string]string{"tier": "frontend"}},
+		{name: "db", namespace: "default"},
+		{name: "job", namespace: "batch", labels: map[string]string{"tier": "frontend"}},
+		{name: "unsafe", namespace: "batch", annotations: map[string]string{safeToEvictAnnotation: "false"}},
+	} {
+		pod := makePod(pod{name: p.name, namespace: p.namespace, nodeName: "localhost"})
+		pod.Labels = p.labels
+		pod.Annotations = p.annotations
+		pods = append(pods, pod)
+	}
+	evictionHandler := &podEvictionHandler{phases: phases}
+	var actualPods [][]string
+	var actualGraces []time.Duration
+	for _, tier := range evictionHandler.groupPods(pods, time.Minute) {
+		var names []string
+		for _, pod := range tier.pods {
+			names = append(names, pod.Name)
+		}
+		actualPods = append(actualPods, names)
+		actualGraces = append(actualGraces, tier.gracePeriod)
+	}
+	expectedPods := [][]string{{"job"}, {"web"}, {"db"}, {"fluentbit", "unsafe"}}
+	expectedGraces := []time.Duration{10 * time.Second, 20 * time.Second, 0, 30 * time.Second}
+	if !reflect.DeepEqual(actualPods, expectedPods) || !reflect.DeepEqual(actualGraces, expectedGraces) {
+		t.Errorf("expected phases %v with grace periods %v, got %v with %v", expectedPods, expectedGraces, actualPods, actualGraces)
+	}
+}
+
+func TestValidateEvictionPhases(t *testing.T) {
+	for _, phases := range [][]EvictionPhase{
+		{{Name: "frontend", Selector: "tier=frontend"}},
+		{{Name: "a"}, {Name: "b"}},
+		{{Name: "invalid selector", Selector: "tier in (frontend"}, {Name: "rest"}},
+		{{Name: "invalid strategy", GracePeriodStrategy: "Proportional"}},
+		{{Name: "batch", Namespaces: []string{"batch"}, GracePeriodStrategy: GracePeriodRemaining}, {Name: "rest", GracePeriodStrategy: GracePeriodRemaining}},
+	} {
+		if err := ValidateEvictionPhases(phases); err == nil {
+			t.Errorf("expected phases %+v to be invalid", phases)
+		}
+	}
+}
+
+func TestNewPodEvictionHandlerValidatesPhases(t *testing.T) {
+	client := kubernetes.NewForConfigOrDie(&rest.Config{Host: "localhost"})
+	// Pods are evicted in the default phases if neither phases nor priority tiers are specified.
+	evictionHandler, err := NewPodEvictionHandler("localhost", client, record.NewFakeRecorder(20), PodEvictionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pods := []v1.Pod{
+		makePod(pod{name: "web", namespace: "default", nodeName: "localhost"}),
+		makePod(pod{name: "dns", namespace: "kube-system", nodeName: "localhost"}),
+	}
+	if tiers := evictionHandler.(*podEvictionHandler).groupPods(pods, time.Minute); len(tiers) != 2 {
+		t.Errorf("expected pods to be evicted in the default phases, got %+v", tiers)
+	}
+	for _, options := range []PodEvictionOptions{
+		{Phases: []EvictionPhase{{Name: "all", Selector: "=invalid"}}},
+		{Phases: []EvictionPhase{{Name: "system", Namespaces: []string{"kube-system"}}}},
+		{PriorityTiers: []ShutdownGracePeriodByPodPriority{{Priority: 0, ShutdownGracePeriodSeconds: -1}}},
+	} {
+		if _, err := NewPodEvictionHandler("localhost", client, record.NewFakeRecorder(20), options); err == nil {
+			t.Errorf("expected options %+v to be rejected", options)
+		}
+	}
+}
@@ -24,8 +24,30 @@ type NodeTerminationState struct {
 	PendingTermination bool
 	// Aboslute time at which the node is expected to be terminated.
 	TerminationTime time.Time
+	// ObservedTime is when the pending termination was first observed, possibly by a previous run of the handler.
+	ObservedTime time.Time
 	// NeedsReboot indicates if a reboot is applicable to handle the pending termination.
 	NeedsReboot bool
+	// WillBeStopped indicates that the VM is stopped rather than deleted when terminated.
+	// The node is expected to come back once the VM is started again.
+	WillBeStopped bool
+	// Reason describes why the termination is pending, if the termination source tells.
+	Reason string
+	// Source names the termination source that raised the pending termination when multiple sources are combined.
+	Source string
+	// UpcomingMaintenance is set when maintenance has been announced ahead of the actual termination.
+	UpcomingMaintenance *MaintenanceWindow
+	// LiveMigration is set while the VM is being live migrated to another host. Pods are not evicted for live migrations.
+	LiveMigration bool
+}
+
+// MaintenanceWindow describes host maintenance announced ahead of time.
+type MaintenanceWindow struct {
+	// Start and End bound the time range during which the maintenance is expected to happen.
+	Start time.Time
+	End   time.Time
+	// CanReschedule indicates if the maintenance can be triggered ahead of the window.
+	CanReschedule bool
 }
 
 // NodeTerminationSource is an abstract repsentation of objects that tracks impending terminations for a node.
@@ -36,20 +58,80 @@ type NodeTerminationSource interface {
 	GetState() NodeTerminationState
 }
 
+// NodeTerminationAcknowledger is implemented by termination sources that need to be told once a pending termination has been handled.
+type NodeTerminationAcknowledger interface {
+	// AcknowledgeTermination is invoked after all pods have been evicted for the pending termination in `state`.
+	AcknowledgeTermination(state NodeTerminationState) error
+}
+
+// MetadataClient is an abstract representation of the GCE metadata server.
+type MetadataClient interface {
+	// Get returns the value of the metadata entry at `suffix`.
+	Get(suffix string) (string, error)
+	// Subscribe invokes `fn` with the current value of the metadata entry at `suffix` and then with every update.
+	// It blocks until `fn` returns an error or the entry is deleted, in which case `fn` is invoked with `ok` set to false.
+	Subscribe(suffix string, fn func(v string, ok bool) error) error
+	// InstanceName returns the name of the current instance.
+	InstanceName() (string, error)
+	// Zone returns the zone of the current instance.
+	Zone() (string, error)
+	// ProjectID returns the project ID of the current instance.
+	ProjectID() (string, error)
+}
+
 // NodeTaintHandler is an abstract representation of objects that can taint or untaint a k8s node.
 type NodeTaintHandler interface {
 	// ApplyTaint taints the node with a special taint specified during object initialization.
 	ApplyTaint() error
-	// RemoveTaint untaints the node of a special taint specified during object initialization.
+	// ApplyAdvanceNoticeTaint discourages scheduling on the node ahead of the maintenance `window`.
+	ApplyAdvanceNoticeTaint(window MaintenanceWindow) error
+	// RemoveTaint untaints the node of the taints specified during object initialization.
 	RemoveTaint() error
+	// MarkLiveMigration records on the node whether a live migration is in progress.
+	MarkLiveMigration(inProgress bool) error
 }
 
 // PodEvictionHandler is an abstract representation of objects that can delete pods from all namespaces running on a specified node.
 type PodEvictionHandler interface {
-	// EvictPods deletes all pods except the ones included in `excludePods`
-	// `excludePods` is a map where the key is pod name and value is pod namespace.
+	// EvictPods deletes all pods except the ones excluded by `exclusions`.
 	// `timeout` is the overall time available to evict all pods.
-	EvictPods(excludePods map[string]string, timeout time.Duration) error
+	// Evictions that have not been issued yet are abandoned once `stopCh` is closed, in which case EvictPods returns early.
+	EvictPods(exclusions *PodExclusions, timeout time.Duration, stopCh <-chan struct{}) error
+}
+
+// VolumeDetachWaiter is implemented by eviction handlers that can wait for the volumes of evicted pods to be detached.
+type VolumeDetachWaiter interface {
+	// WaitForVolumeDetach waits until the persistent volumes of the pods evicted by the last call to EvictPods are
+	// detached from the node or `deadline` is reached.
+	// It returns the names of the volumes that are still attached.
+	WaitForVolumeDetach(deadline time.Time) ([]string, error)
+}
+
+// NodeRebooter is an abstract representation of objects that can reboot the node.
+type NodeRebooter interface {
+	// Reboot restarts the node once all pods have been evicted for a pending termination that needs a reboot.
+	Reboot() error
+}
+
+// PodExecutor is an abstract representation of the ability to run commands in containers.
+type PodExecutor interface {
+	// Exec runs `command` in `container` of pod `name` in `namespace` and returns its output.
+	// An error is returned if the command fails or does not exit within `timeout`.
+	Exec(namespace, name, container string, command []string, timeout time.Duration) (string, error)
+}
+
+// Notifier is an abstract representation of the ability to notify operators about the node.
+type Notifier interface {
+	// Notify sends a notification titled `title`.
+	Notify(title string) error
+}
+
+// LiveMigrationHook is an abstract representation of actions to run around live migrations, such as pausing latency sensitive pods.
+type LiveMigrationHook interface {
+	// MigrationStarted is invoked once a live migration of the node has been announced.
+	MigrationStarted() error
+	// MigrationCompleted is invoked once the live migration of the node has completed.
+	MigrationCompleted() error
 }
 
 // NodeTerminationHandler is an abstract representation of objects that can handle node terminations gracefully.
@@ -0,0 +1,170 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// volumesAttachedReason is recorded on the node when volumes are still attached to it by the time it is rebooted.
+const volumesAttachedReason = "VolumesStillAttached"
+
+// volumeDetachPollInterval is the interval at which volume attachments are listed. They cannot be selected by node,
+// so every poll lists the attachments of the whole cluster.
+var volumeDetachPollInterval = 10 * time.Second
+
+// volumeClaims are the persistent volume claims mounted by the pods of a drain, by namespace and name.
+type volumeClaims map[string]*v1.PersistentVolumeClaim
+
+// getClaims gets the persistent volume claims mounted by `pods`. Each claim is only fetched once per drain, since both
+// the order of evictions and the volumes to wait for depend on them. Claims that cannot be fetched are left out.
+func (p *podEvictionHandler) getClaims(pods []v1.Pod) volumeClaims {
+	claims := volumeClaims{}
+	for _, pod := range pods {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim == nil {
+				continue
+			}
+			key := claimKey(pod.Namespace, volume.PersistentVolumeClaim.ClaimName)
+			if _, exists := claims[key]; exists {
+				continue
+			}
+			claim, err := p.client.PersistentVolumeClaims(pod.Namespace).Get(volume.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+			if err != nil {
+				glog.V(2).Infof("Failed to get persistent volume claim %q of pod %q in namespace %q - %v", volume.PersistentVolumeClaim.ClaimName, pod.Name, pod.Namespace, err)
+				// Claims that cannot be fetched are not fetched again within the drain either.
+				claims[key] = nil
+				continue
+			}
+			claims[key] = claim
+		}
+	}
+	return claims
+}
+
+// claimKey returns the key of the claim `name` in `namespace` within volumeClaims.
+func claimKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// mounted returns the claims among `claims` that are mounted by `pod`.
+func (claims volumeClaims) mounted(pod v1.Pod) []*v1.PersistentVolumeClaim {
+	var mounted []*v1.PersistentVolumeClaim
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		if claim := claims[claimKey(pod.Namespace, volume.PersistentVolumeClaim.ClaimName)]; claim != nil {
+			mounted = append(mounted, claim)
+		}
+	}
+	return mounted
+}
+
+// sortByVolumes returns `pods` with the pods holding ReadWriteOnce persistent volumes first, such that their volumes can be
+// attached to the nodes their replacements are scheduled on as soon as possible. The order of pods is otherwise preserved.
+func sortByVolumes(pods []v1.Pod, claims volumeClaims) []v1.Pod {
+	var first, rest []v1.Pod
+	for _, pod := range pods {
+		if holdsReadWriteOnceVolume(pod, claims) {
+			first = append(first, pod)
+		} else {
+			rest = append(rest, pod)
+		}
+	}
+	return append(first, rest...)
+}
+
+// holdsReadWriteOnceVolume returns true if `pod` mounts a persistent volume claim that can only be attached to a single node.
+func holdsReadWriteOnceVolume(pod v1.Pod, claims volumeClaims) bool {
+	for _, claim := range claims.mounted(pod) {
+		for _, mode := range claim.Spec.AccessModes {
+			if mode == v1.ReadWriteOnce {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recordVolumes adds the persistent volumes bound to the claims mounted by `pods` to the volumes to wait for.
+func (p *podEvictionHandler) recordVolumes(pods []v1.Pod, claims volumeClaims) {
+	for _, pod := range pods {
+		for _, claim := range claims.mounted(pod) {
+			if claim.Spec.VolumeName == "" {
+				continue
+			}
+			if p.evictedVolumes == nil {
+				p.evictedVolumes = map[string]bool{}
+			}
+			p.evictedVolumes[claim.Spec.VolumeName] = true
+		}
+	}
+}
+
+// WaitForVolumeDetach ignores the volumes of pods that were not evicted, such as DaemonSet and static pods, since
+// they stay attached until the node is gone.
+func (p *podEvictionHandler) WaitForVolumeDetach(deadline time.Time) ([]string, error) {
+	if len(p.evictedVolumes) == 0 {
+		return nil, nil
+	}
+	var (
+		attached []string
+		listErr  error
+	)
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		// Check attachments once rather than never timing out.
+		timeout = time.Nanosecond
+	}
+	err := wait.PollImmediate(volumeDetachPollInterval, timeout, func() (bool, error) {
+		// Volume attachments cannot be selected by node.
+		attachments, err := p.storageClient.VolumeAttachments().List(metav1.ListOptions{})
+		listErr = err
+		if err != nil {
+			glog.V(2).Infof("Failed to list volume attachments - %v", err)
+			return false, nil
+		}
+		attached = nil
+		for _, attachment := range attachments.Items {
+			source := attachment.Spec.Source.PersistentVolumeName
+			if attachment.Spec.NodeName != p.node || source == nil || !p.evictedVolumes[*source] {
+				continue
+			}
+			attached = append(attached, *source)
+		}
+		return len(attached) == 0, nil
+	})
+	if err == wait.ErrWaitTimeout && listErr != nil {
+		return nil, listErr
+	}
+	if err == wait.ErrWaitTimeout {
+		sort.Strings(attached)
+		glog.Errorf("Volumes %v are still attached to node %q", attached, p.node)
+		node := &v1.ObjectReference{Kind: "Node", Name: p.node, UID: types.UID(p.node)}
+		p.recorder.Eventf(node, v1.EventTypeWarning, volumesAttachedReason, "Node %q is about to be terminated with volumes still attached: %s.", p.node, strings.Join(attached, ", "))
+		return attached, nil
+	}
+	return attached, err
+}
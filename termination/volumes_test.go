@@ -0,0 +1,192 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termination
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekubeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func makeClaim(name string, mode v1.PersistentVolumeAccessMode) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       v1.PersistentVolumeClaimSpec{AccessModes: []v1.PersistentVolumeAccessMode{mode}},
+	}
+}
+
+func makeAttachment(name, volume, node string) *storage.VolumeAttachment {
+	return &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storage.VolumeAttachmentSpec{
+			NodeName: node,
+			Source:   storage.VolumeAttachmentSource{PersistentVolumeName: &volume},
+		},
+	}
+}
+
+func TestSortByVolumes(t *testing.T) {
+	kubeClientset := fakekubeclientset.NewSimpleClientset(
+		makeClaim("shared", v1.ReadWriteMany),
+		makeClaim("db-0", v1.ReadWriteOnce),
+		makeClaim("db-1", v1.ReadWriteOnce),
+	)
+	evictionHandler := &podEvictionHandler{client: kubeClientset.CoreV1()}
+	pods := []v1.Pod{
+		makePod(pod{name: "web", namespace: "default", nodeName: "localhost"}),
+		makePod(pod{name: "db-0", namespace: "default", nodeName: "localhost", claim: "db-0"}),
+		makePod(pod{name: "cms", namespace: "default", nodeName: "localhost", claim: "shared"}),
+		makePod(pod{name: "missing", namespace: "default", nodeName: "localhost", claim: "missing"}),
+		makePod(pod{name: "db-1", namespace: "default", nodeName: "localhost", claim: "db-1"}),
+	}
+	var sorted []string
+	for _, pod := range sortByVolumes(pods, evictionHandler.getClaims(pods)) {
+		sorted = append(sorted, pod.Name)
+	}
+	if expected := []string{"db-0", "db-1", "web", "cms", "missing"}; !reflect.DeepEqual(sorted, expected) {
+		t.Errorf("expected pods to be sorted as %v, got %v", expected, sorted)
+	}
+}
+
+func TestRecordVolumes(t *testing.T) {
+	bound := makeClaim("db-0", v1.ReadWriteOnce)
+	bound.Spec.VolumeName = "pv-db-0"
+	kubeClientset := fakekubeclientset.NewSimpleClientset(bound, makeClaim("pending", v1.ReadWriteOnce))
+	evictionHandler := &podEvictionHandler{client: kubeClientset.CoreV1()}
+	pods := []v1.Pod{
+		makePod(pod{name: "web", namespace: "default", nodeName: "localhost"}),
+		makePod(pod{name: "db-0", namespace: "default", nodeName: "localhost", claim: "db-0"}),
+		makePod(pod{name: "pending", namespace: "default", nodeName: "localhost", claim: "pending"}),
+		makePod(pod{name: "missing", namespace: "default", nodeName: "localhost", claim: "missing"}),
+	}
+	evictionHandler.recordVolumes(pods, evictionHandler.getClaims(pods))
+	if expected := map[string]bool{"pv-db-0": true}; !reflect.DeepEqual(evictionHandler.evictedVolumes, expected) {
+		t.Errorf("expected volumes %v to be recorded, got %v", expected, evictionHandler.evictedVolumes)
+	}
+}
+
+func TestGetClaimsFetchesEachClaimOnce(t *testing.T) {
+	kubeClientset := fakekubeclientset.NewSimpleClientset(makeClaim("shared", v1.ReadWriteMany))
+	evictionHandler := &podEvictionHandler{client: kubeClientset.CoreV1()}
+	claims := evictionHandler.getClaims([]v1.Pod{
+		makePod(pod{name: "cms-0", namespace: "default", nodeName: "localhost", claim: "shared"}),
+		makePod(pod{name: "cms-1", namespace: "default", nodeName: "localhost", claim: "shared"}),
+		makePod(pod{name: "missing-0", namespace: "default", nodeName: "localhost", claim: "missing"}),
+		makePod(pod{name: "missing-1", namespace: "default", nodeName: "localhost", claim: "missing"}),
+	})
+	if len(claims) != 2 || claims[claimKey("default", "shared")] == nil || claims[claimKey("default", "missing")] != nil {
+		t.Errorf("expected the shared claim to be found and the missing one not to be, got %v", claims)
+	}
+	if actions := kubeClientset.Actions(); len(actions) != 2 {
+		t.Errorf("expected each claim to be fetched once, got %v", actions)
+	}
+}
+
+func TestEvictionsFetchEachClaimOnce(t *testing.T) {
+	bound := makeClaim("shared", v1.ReadWriteOnce)
+	bound.Spec.VolumeName = "pv-shared"
+	podList := v1.PodList{Items: []v1.Pod{
+		makePod(pod{name: "db-0", namespace: "default", nodeName: "localhost", claim: "shared"}),
+		makePod(pod{name: "db-1", namespace: "default", nodeName: "localhost", claim: "shared"}),
+	}}
+	kubeClientset := fakekubeclientset.NewSimpleClientset(&podList, bound)
+	evictionHandler := &podEvictionHandler{
+		client:                 kubeClientset.CoreV1(),
+		policyClient:           newFakePolicyClient(kubeClientset.CoreV1()),
+		node:                   "localhost",
+		recorder:               record.NewFakeRecorder(20),
+		phases:                 defaultEvictionPhases(t),
+		maxConcurrentEvictions: 1,
+		rateLimiter:            flowcontrol.NewFakeAlwaysRateLimiter(),
+	}
+	if err := evictionHandler.EvictPods(nil, 30*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	var gets int
+	for _, action := range kubeClientset.Actions() {
+		if action.Matches("get", "persistentvolumeclaims") {
+			gets++
+		}
+	}
+	if gets != 1 {
+		t.Errorf("expected the claim to be fetched once per drain, got %d requests", gets)
+	}
+	if expected := map[string]bool{"pv-shared": true}; !reflect.DeepEqual(evictionHandler.evictedVolumes, expected) {
+		t.Errorf("expected volumes %v to be recorded, got %v", expected, evictionHandler.evictedVolumes)
+	}
+}
+
+func TestWaitForVolumeDetach(t *testing.T) {
+	defer func(interval time.Duration) {
+		volumeDetachPollInterval = interval
+	}(volumeDetachPollInterval)
+	volumeDetachPollInterval = 100 * time.Millisecond
+	kubeClientset := fakekubeclientset.NewSimpleClientset(
+		makeAttachment("a", "pv-a", "localhost"),
+		makeAttachment("b", "pv-b", "localhost"),
+		makeAttachment("c", "pv-c", "other"),
+		// The volume of a pod that was not evicted stays attached.
+		makeAttachment("d", "pv-d", "localhost"),
+	)
+	recorder := record.NewFakeRecorder(20)
+	evictionHandler := &podEvictionHandler{
+		storageClient:  kubeClientset.StorageV1beta1(),
+		node:           "localhost",
+		recorder:       recorder,
+		evictedVolumes: map[string]bool{"pv-a": true, "pv-b": true, "pv-c": true},
+	}
+	time.AfterFunc(500*time.Millisecond, func() {
+		kubeClientset.StorageV1beta1().VolumeAttachments().Delete("a", nil)
+	})
+	attached, err := evictionHandler.WaitForVolumeDetach(time.Now().Add(2 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"pv-b"}; !reflect.DeepEqual(attached, expected) {
+		t.Errorf("expected volumes %v to remain attached, got %v", expected, attached)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, volumesAttachedReason) || !strings.Contains(event, "pv-b") {
+		t.Errorf("expected an event reporting attached volumes, got %q", event)
+	}
+
+	kubeClientset.StorageV1beta1().VolumeAttachments().Delete("b", nil)
+	attached, err = evictionHandler.WaitForVolumeDetach(time.Now().Add(-time.Second))
+	if err != nil || len(attached) != 0 {
+		t.Errorf("expected all volumes to be detached, got %v, %v", attached, err)
+	}
+}
+
+func TestWaitForVolumeDetachWithoutEvictedVolumes(t *testing.T) {
+	kubeClientset := fakekubeclientset.NewSimpleClientset(makeAttachment("a", "pv-a", "localhost"))
+	evictionHandler := &podEvictionHandler{
+		storageClient: kubeClientset.StorageV1beta1(),
+		node:          "localhost",
+	}
+	attached, err := evictionHandler.WaitForVolumeDetach(time.Now().Add(time.Minute))
+	if err != nil || len(attached) != 0 {
+		t.Errorf("expected no volume to be waited for, got %v, %v", attached, err)
+	}
+	if actions := kubeClientset.Actions(); len(actions) != 0 {
+		t.Errorf("expected volume attachments not to be listed, got %v", actions)
+	}
+}